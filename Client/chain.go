@@ -0,0 +1,165 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	config "github.com/stvp/go-toml-config"
+)
+
+// Hop is one host in the chain leading to the proxy, which is the last hop.
+// The jump hosts are configured as [hop.1], [hop.2], ... sections and are
+// traversed in order, each one reached through the one before it.
+type Hop struct {
+	Name     string
+	Host     string
+	User     string
+	Port     int
+	Identity string
+	Auth     string
+	// Fingerprint pins the host key, e.g. "SHA256:..."
+	Fingerprint string
+}
+
+type hopOptions struct {
+	index       int
+	host        *string
+	user        *string
+	port        *int
+	identity    *string
+	auth        *string
+	fingerprint *string
+}
+
+// hopOptionLists holds the hops of each profile, "" being the top level.
+var hopOptionLists = map[string][]*hopOptions{}
+
+var hopSectionRe = regexp.MustCompile(`^\s*\[(profile\.([A-Za-z0-9_-]+)\.)?hop\.([0-9]+)\]`)
+
+// declareHops scans the config file for [hop.N] and [profile.<name>.hop.N]
+// sections and declares their options before the file is parsed, as only
+// declared options are accepted.
+func declareHops(path string) {
+	lines, err := readLines(path)
+	if err != nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, line := range lines {
+		result := hopSectionRe.FindStringSubmatch(line)
+		if len(result) != 4 || seen[result[1]+result[3]] {
+			continue
+		}
+		seen[result[1]+result[3]] = true
+		index, _ := strconv.Atoi(result[3])
+		prefix := result[1] + "hop." + result[3] + "."
+		hopOptionLists[result[2]] = append(hopOptionLists[result[2]], &hopOptions{
+			index:       index,
+			host:        config.String(prefix+"host", ""),
+			user:        config.String(prefix+"user", ""),
+			port:        config.Int(prefix+"port", 22),
+			identity:    config.String(prefix+"identity", ""),
+			auth:        config.String(prefix+"auth", ""),
+			fingerprint: config.String(prefix+"fingerprint", ""),
+		})
+	}
+	for _, list := range hopOptionLists {
+		sort.Slice(list, func(i, j int) bool { return list[i].index < list[j].index })
+	}
+}
+
+// hopChain returns the jump hosts of the selected profile followed by the
+// proxy itself. A profile only uses the hops given in its own sections.
+func hopChain() []Hop {
+	var chain []Hop
+	for _, opt := range hopOptionLists[profileName] {
+		chain = append(chain, Hop{fmt.Sprintf("trr-hop-%d", opt.index), *opt.host, *opt.user, *opt.port, *opt.identity, *opt.auth, *opt.fingerprint})
+	}
+	return append(chain, Hop{*proxyServerAddr, *proxyServerAddr, *proxyUser, *proxySSHPort, *proxyIdentity, *proxyAuth, *proxyFingerprint})
+}
+
+func (h Hop) String() string {
+	s := h.Host
+	if h.User != "" {
+		s = h.User + "@" + s
+	}
+	return fmt.Sprintf("%s:%d", s, h.Port)
+}
+
+// writeSSHConfig writes the ssh client config used for every ssh command.
+// Each hop is a host entry jumping through the previous one, so the final
+// entry, named as the proxy address, reaches the proxy through the chain.
+func writeSSHConfig(path string) error {
+	var b bytes.Buffer
+	previous := ""
+	chain := hopChain()
+	for i, hop := range chain {
+		fmt.Fprintf(&b, "Host %s\n  HostName %s\n  Port %d\n", hop.Name, hop.Host, hop.Port)
+		if i == len(chain)-1 && *addressFamily != "any" {
+			// the master connection binds the forwards by the family of the proxy
+			fmt.Fprintf(&b, "  AddressFamily %s\n", *addressFamily)
+		}
+		fmt.Fprintf(&b, "  UserKnownHostsFile %s\n", knownHostsFile)
+		if hop.Fingerprint != "" {
+			fmt.Fprintf(&b, "  StrictHostKeyChecking yes\n")
+		} else {
+			fmt.Fprintf(&b, "  StrictHostKeyChecking accept-new\n")
+		}
+		if hop.User != "" {
+			fmt.Fprintf(&b, "  User %s\n", hop.User)
+		}
+		if hop.Identity != "" {
+			fmt.Fprintf(&b, "  IdentityFile %s\n  IdentitiesOnly yes\n", hop.Identity)
+		}
+		switch hop.Auth {
+		case "":
+		case "agent", "key":
+			fmt.Fprintf(&b, "  PreferredAuthentications publickey\n")
+		case "publickey", "password", "keyboard-interactive", "gssapi-with-mic":
+			fmt.Fprintf(&b, "  PreferredAuthentications %s\n", hop.Auth)
+		default:
+			return fmt.Errorf("unknown auth %q for %s", hop.Auth, hop.Host)
+		}
+		if previous != "" {
+			fmt.Fprintf(&b, "  ProxyJump %s\n", previous)
+		}
+		previous = hop.Name
+	}
+	// keep the settings of the user for everything not given above
+	fmt.Fprintf(&b, "Host *\n  Include ~/.ssh/config\n")
+
+	return ioutil.WriteFile(path, b.Bytes(), 0600)
+}
+
+// sshCommand returns an ssh command using the config of the hop chain.
+func sshCommand(arg ...string) *exec.Cmd {
+	return exec.Command(*sshbin, append([]string{"-F", sshConfigFile}, arg...)...)
+}
@@ -0,0 +1,338 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The states of a probed tunnel. A tunnel is unreachable when its local end
+// is up but the far end refuses the connection.
+const (
+	stateUp          = "up"
+	stateDown        = "down"
+	stateUnreachable = "unreachable"
+)
+
+// TunnelHealth is the outcome of probing one recorded tunnel. Latency is in
+// milliseconds.
+type TunnelHealth struct {
+	Tunnel  TunnelRecord
+	State   string
+	Latency float64 `json:",omitempty"`
+	Error   string  `json:",omitempty"`
+}
+
+func (h TunnelHealth) String() string {
+	s := fmt.Sprintf("%s: %s", h.Tunnel, h.State)
+	if h.Latency > 0 {
+		s += fmt.Sprintf(" %.1fms", h.Latency)
+	}
+	if h.Error != "" {
+		s += " (" + h.Error + ")"
+	}
+	return s
+}
+
+func checkTimeoutDuration() time.Duration {
+	return time.Duration(*checkTimeout) * time.Second
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// masterAlive tells if the master connection answers, not only if its
+// control socket is there.
+func masterAlive() bool {
+	if _, err := os.Stat(ctrlSocket); err != nil {
+		return false
+	}
+	return sshCommand("-O", "check", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr).Run() == nil
+}
+
+// masterEcho runs a command on the proxy through the master connection and
+// returns the round trip time.
+func masterEcho() (time.Duration, error) {
+	start := time.Now()
+	err := sshCommand("-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr, "exit").Run()
+	return time.Since(start), err
+}
+
+// probeSettle is how long a probed forward is held open to hear back from
+// the far end. A refusal comes back within a round trip through the proxy.
+const probeSettle = time.Second
+
+// probeLocal connects to the local end of a tunnel. ssh closes a forwarded
+// connection as soon as the far end refuses it, so when end to end is set
+// the connection is kept open until the far end says something or
+// probeSettle passes, whichever comes first. Silence means it accepted.
+func probeLocal(network string, addr string, endToEnd bool) (time.Duration, string, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout(network, addr, checkTimeoutDuration())
+	if err != nil {
+		return 0, stateDown, err
+	}
+	defer conn.Close()
+	latency := time.Since(start)
+	if !endToEnd {
+		return latency, stateUp, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(probeSettle))
+	var b [1]byte
+	_, err = conn.Read(b[:])
+	if err == io.EOF {
+		return 0, stateUnreachable, fmt.Errorf("closed by the far end")
+	}
+	if err == nil {
+		latency = time.Since(start)
+	}
+	return latency, stateUp, nil
+}
+
+// listenAddr returns where the local end of a tunnel spec listens.
+func listenAddr(spec TunnelSpec) (string, string) {
+	if spec.Socket != "" {
+		return "unix", spec.Socket
+	}
+	host := spec.Bind
+	switch host {
+	case "", "localhost", "*":
+		host = "127.0.0.1"
+	}
+	return "tcp", joinHostPort(host, spec.Port)
+}
+
+// targetAddr returns the far end of a tunnel spec.
+func targetAddr(spec TunnelSpec) (string, string) {
+	if spec.HostSocket != "" {
+		return "unix", spec.HostSocket
+	}
+	return "tcp", joinHostPort(spec.Host, spec.HostPort)
+}
+
+// checkTunnel probes one recorded tunnel. listening holds the ports that
+// listen on the proxy, nil if they could not be read.
+func checkTunnel(record TunnelRecord, listening map[int]bool) TunnelHealth {
+	health := TunnelHealth{Tunnel: record, State: stateUp}
+	var latency time.Duration
+	var err error
+
+	if _, ok := daemonCommands[record.Kind]; ok && !isDaemon(record.Pid, record) {
+		health.State, health.Error = stateDown, "daemon not running"
+		return health
+	}
+
+	switch record.Kind {
+	case "Forward":
+		spec, perr := parseTunnelSpec(record.Spec)
+		if perr != nil {
+			health.State, health.Error = stateDown, perr.Error()
+			return health
+		}
+		network, addr := listenAddr(spec)
+		latency, health.State, err = probeLocal(network, addr, true)
+	case "Remote":
+		spec, perr := parseTunnelSpec(record.Spec)
+		if perr != nil {
+			health.State, health.Error = stateDown, perr.Error()
+			return health
+		}
+		if spec.Socket == "" && listening != nil && !listening[spec.Port] {
+			health.State, health.Error = stateDown, fmt.Sprintf("port %d not listening on %s", spec.Port, *proxyServerAddr)
+			return health
+		}
+		network, addr := targetAddr(spec)
+		latency, health.State, err = probeLocal(network, addr, false)
+		if health.State == stateDown {
+			health.State = stateUnreachable
+		}
+	case "SOCKS", "Socks5", "HttpProxy":
+		latency, health.State, err = probeLocal("tcp", joinHostPort("127.0.0.1", atoi(record.Spec)), false)
+	}
+	if err != nil {
+		health.Error = err.Error()
+	}
+	health.Latency = milliseconds(latency)
+	return health
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// checkTunnels probes every recorded tunnel.
+func checkTunnels(records []TunnelRecord) []TunnelHealth {
+	var listening map[int]bool
+	for _, record := range records {
+		if record.Kind == "Remote" {
+			listening, _ = remoteListeningPorts()
+			break
+		}
+	}
+	var health []TunnelHealth
+	for _, record := range records {
+		health = append(health, checkTunnel(record, listening))
+	}
+	return health
+}
+
+// rebuildTunnel opens a tunnel found down again through the running master
+// connection. A daemon started again gets a new pid, which is returned.
+func rebuildTunnel(record TunnelRecord) (TunnelRecord, error) {
+	if name, ok := daemonCommands[record.Kind]; ok {
+		pid, _, err := startDaemon(name, record.Spec)
+		record.Pid = pid
+		return record, err
+	}
+	var direction string
+	spec := record.Spec
+	switch record.Kind {
+	case "Forward":
+		direction = "-L"
+	case "Remote":
+		direction = "-R"
+	case "SOCKS":
+		direction = "-D"
+	default:
+		return record, fmt.Errorf("%s tunnels cannot be rebuilt", record.Kind)
+	}
+	// the master connection may still hold the forward without its listener
+	sshCommand("-O", "cancel", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), direction, spec, *proxyServerAddr).Run()
+	return record, openTunnel(direction, spec)
+}
+
+// heal is one round of the agent: a dead master connection is reconnected
+// with every tunnel, otherwise the tunnels found down are rebuilt.
+func heal() {
+	if !masterAlive() {
+		lock, holder, err := tryLock(lockPath(ctrlSocket))
+		if err != nil || lock == nil {
+			log.Printf("master connection to %s is dead, left to pid %d", *proxyServerAddr, holder)
+			return
+		}
+		defer lock.Close()
+		log.Printf("master connection to %s is dead, reconnecting", *proxyServerAddr)
+		failed, err := reconnect()
+		if err != nil && err != errStillAttached {
+			log.Printf("reconnect failed: %v", err)
+		}
+		for _, record := range failed {
+			log.Printf("%s could not be restored", record)
+		}
+		return
+	}
+
+	records, err := readTunnelRecords(tunnelListFile)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	changed := false
+	for i, health := range checkTunnels(records) {
+		if health.State != stateDown || health.Tunnel.Kind == "Agent" {
+			continue
+		}
+		log.Printf("%s", health)
+		record, err := rebuildTunnel(health.Tunnel)
+		if err != nil {
+			log.Printf("%s could not be rebuilt: %v", health.Tunnel, err)
+			continue
+		}
+		log.Printf("%s rebuilt", record)
+		if record.Pid != records[i].Pid {
+			records[i] = record
+			changed = true
+		}
+	}
+	if changed {
+		if err := writeTunnelRecords(tunnelListFile, records); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+}
+
+// runAgent checks the tunnels every interval until stopped, rebuilding the
+// ones that died.
+func runAgent(interval time.Duration) {
+	log.Printf("agent checking %s every %v", *proxyServerAddr, interval)
+	agentLoop(interval, heal)
+}
+
+// agentLoop runs heal every interval until the instance is detached.
+func agentLoop(interval time.Duration, heal func()) {
+	for {
+		time.Sleep(interval)
+		if detached() {
+			log.Printf("%s detached, agent stopped", *proxyServerAddr)
+			return
+		}
+		heal()
+	}
+}
+
+// detached tells whether the instance was detached: the control socket and
+// the tunnel list are both gone and no command holds the lock. A reconnect
+// that failed keeps the tunnel list, so the agent goes on trying.
+func detached() bool {
+	if _, err := os.Stat(tunnelListFile); !os.IsNotExist(err) {
+		return false
+	}
+	if _, err := os.Stat(ctrlSocket); !os.IsNotExist(err) {
+		return false
+	}
+	lock, _, err := tryLock(lockPath(ctrlSocket))
+	if err != nil || lock == nil {
+		return false
+	}
+	lock.Close()
+	return true
+}
+
+// parseInterval parses the optional interval argument of agent in seconds.
+func parseInterval(args []string) (time.Duration, error) {
+	if len(args) == 0 {
+		return time.Duration(*checkInterval) * time.Second, nil
+	}
+	seconds, err := strconv.Atoi(strings.TrimSuffix(args[0], "s"))
+	if err != nil || seconds < 1 {
+		return 0, fmt.Errorf("bad interval %q", args[0])
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func validateInterval(args []string) error {
+	_, err := parseInterval(args)
+	return err
+}
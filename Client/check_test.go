@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testInstance points the files of the instance into a temporary directory
+// and makes ssh fail, as it does while the network is down.
+func testInstance(t *testing.T) {
+	dir := t.TempDir()
+	ctrlSocket = filepath.Join(dir, "proxy.host.0")
+	tunnelListFile = ctrlSocket + ".txt"
+	sshConfigFile = ctrlSocket + ".config"
+	*lockdir = filepath.Join(dir, "locks")
+	*sshbin = "false"
+	userName = "test"
+	if err := createLockdir(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectFailureKeepsTunnelList(t *testing.T) {
+	testInstance(t)
+	records := []TunnelRecord{{Kind: "SOCKS", Spec: "1080"}, {Kind: "Forward", Spec: "8080:web:80", Name: "web"}}
+	if err := writeTunnelRecords(tunnelListFile, records); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconnect(); err == nil {
+		t.Fatal("reconnect succeeded without ssh")
+	}
+	kept, err := readTunnelRecords(tunnelListFile)
+	if err != nil {
+		t.Fatalf("tunnel list lost: %v", err)
+	}
+	if len(kept) != len(records) || kept[0] != records[0] || kept[1] != records[1] {
+		t.Errorf("tunnel list is %v, want %v", kept, records)
+	}
+}
+
+func TestAgentRetriesFailedReconnect(t *testing.T) {
+	testInstance(t)
+	records := []TunnelRecord{{Kind: "Forward", Spec: "8080:web:80"}}
+	if err := writeTunnelRecords(tunnelListFile, records); err != nil {
+		t.Fatal(err)
+	}
+
+	rounds := 0
+	agentLoop(time.Millisecond, func() {
+		rounds++
+		heal()
+		if kept, err := readTunnelRecords(tunnelListFile); err != nil || len(kept) != 1 {
+			t.Fatalf("round %d: tunnel list is %v, %v", rounds, kept, err)
+		}
+		if rounds == 3 {
+			// as detach does
+			os.Remove(tunnelListFile)
+		}
+	})
+	if rounds != 3 {
+		t.Errorf("agent ran %d rounds, want 3", rounds)
+	}
+}
+
+func TestDetachedWhileLocked(t *testing.T) {
+	testInstance(t)
+	lock, _, err := tryLock(lockPath(ctrlSocket))
+	if err != nil || lock == nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if detached() {
+		t.Error("detached while another command holds the lock")
+	}
+	lock.Close()
+	if !detached() {
+		t.Error("not detached without socket, list and lock holder")
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	*checkInterval = 30
+	tests := []struct {
+		args []string
+		want time.Duration
+		ok   bool
+	}{
+		{nil, 30 * time.Second, true},
+		{[]string{"10"}, 10 * time.Second, true},
+		{[]string{"5s"}, 5 * time.Second, true},
+		{[]string{"0"}, 0, false},
+		{[]string{"x"}, 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseInterval(test.args)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseInterval(%v) = %v, %v", test.args, got, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"sort"
+	"strings"
+	config "github.com/stvp/go-toml-config"
+)
+
+// ConfigProblem is a problem of an option of the config file. Warnings are
+// reported by --check-config without failing it.
+type ConfigProblem struct {
+	Option  string
+	Problem string
+	Warning bool
+}
+
+// configChecker collects the problems of the parsed config file.
+type configChecker struct {
+	problems []ConfigProblem
+}
+
+func (c *configChecker) add(option string, format string, a ...interface{}) {
+	c.problems = append(c.problems, ConfigProblem{option, fmt.Sprintf(format, a...), false})
+}
+
+func (c *configChecker) warn(option string, format string, a ...interface{}) {
+	c.problems = append(c.problems, ConfigProblem{option, fmt.Sprintf(format, a...), true})
+}
+
+func (c *configChecker) port(option string, port int) {
+	if port < 1 || port > 65535 {
+		c.add(option, "%d is not a port", port)
+	}
+}
+
+func (c *configChecker) portRange(first string, last string, start int, end int) {
+	c.port(first, start)
+	c.port(last, end)
+	if start > end {
+		c.add(first, "%d is after %s %d", start, last, end)
+	}
+}
+
+func (c *configChecker) positive(option string, n int) {
+	if n < 1 {
+		c.add(option, "%d is not positive", n)
+	}
+}
+
+func (c *configChecker) oneOf(option string, value string, values ...string) {
+	for _, v := range values {
+		if value == v {
+			return
+		}
+	}
+	c.add(option, "unknown value %q, use %s", value, strings.Join(values, ", "))
+}
+
+func (c *configChecker) host(option string, host string) {
+	if host == "" {
+		c.add(option, "no host given")
+	} else if net.ParseIP(host) == nil && !hostnameRe.MatchString(host) {
+		c.add(option, "%q is not a host", host)
+	}
+}
+
+func (c *configChecker) auth(option string, auth string) {
+	if auth != "" {
+		c.oneOf(option, auth, "agent", "key", "publickey", "password", "keyboard-interactive", "gssapi-with-mic")
+	}
+}
+
+func (c *configChecker) fingerprint(option string, fingerprint string) {
+	if fingerprint != "" && !strings.HasPrefix(fingerprint, "SHA256:") {
+		c.add(option, "%q is not a SHA256: fingerprint", fingerprint)
+	}
+}
+
+func (c *configChecker) file(option string, path string) {
+	if path == "" {
+		return
+	}
+	if strings.HasPrefix(path, "~/") {
+		path = homeDir + path[1:]
+	}
+	if _, err := os.Stat(path); err != nil {
+		c.add(option, "%v", err)
+	}
+}
+
+func (c *configChecker) binary(option string, path string, warning bool) {
+	if _, err := exec.LookPath(path); err != nil {
+		if warning {
+			c.warn(option, "%v", err)
+		} else {
+			c.add(option, "%v", err)
+		}
+	}
+}
+
+// configProblems checks the types and ranges of the options of the parsed
+// config file, the hosts and addresses given and the binaries run.
+func configProblems() []ConfigProblem {
+	c := &configChecker{}
+
+	c.portRange("portStart", "portEnd", *portStart, *portEnd)
+	c.oneOf("portStrategy", *portStrategy, "sequential", "random")
+	c.oneOf("addressFamily", *addressFamily, "any", "inet", "inet6")
+	c.portRange("proxy.socksStart", "proxy.socksEnd", *socksStart, *socksEnd)
+	c.portRange("proxy.httpStart", "proxy.httpEnd", *httpStart, *httpEnd)
+
+	c.host("proxy.address", *proxyServerAddr)
+	c.port("proxy.sshport", *proxySSHPort)
+	c.auth("proxy.auth", *proxyAuth)
+	c.fingerprint("proxy.fingerprint", *proxyFingerprint)
+	c.file("proxy.identity", *proxyIdentity)
+	if *instance < 0 {
+		c.add("instance", "%d is negative", *instance)
+	}
+
+	profiles := profileList()
+	for _, name := range profiles {
+		opt := profileOptionMap[name]
+		prefix := "profile." + name + "."
+		if *opt.address != "" {
+			c.host(prefix+"address", *opt.address)
+		}
+		if *opt.sshport != -1 {
+			c.port(prefix+"sshport", *opt.sshport)
+		}
+		c.auth(prefix+"auth", *opt.auth)
+		c.fingerprint(prefix+"fingerprint", *opt.fingerprint)
+		c.file(prefix+"identity", *opt.identity)
+		if *opt.instance < -1 {
+			c.add(prefix+"instance", "%d is negative", *opt.instance)
+		}
+		if *opt.socksStart != -1 || *opt.socksEnd != -1 {
+			start, end := *socksStart, *socksEnd
+			if *opt.socksStart != -1 {
+				start = *opt.socksStart
+			}
+			if *opt.socksEnd != -1 {
+				end = *opt.socksEnd
+			}
+			c.portRange(prefix+"socksStart", prefix+"socksEnd", start, end)
+		}
+	}
+	for _, profile := range append([]string{""}, profiles...) {
+		for _, opt := range hopOptionLists[profile] {
+			prefix := fmt.Sprintf("hop.%d.", opt.index)
+			if profile != "" {
+				prefix = "profile." + profile + "." + prefix
+			}
+			c.host(prefix+"host", *opt.host)
+			c.port(prefix+"port", *opt.port)
+			c.auth(prefix+"auth", *opt.auth)
+			c.fingerprint(prefix+"fingerprint", *opt.fingerprint)
+			c.file(prefix+"identity", *opt.identity)
+		}
+	}
+
+	if _, _, err := parseHostPort(*tapServer); err != nil {
+		c.add("tap.server", "%v", err)
+	}
+	if *tapPrefix < 1 || *tapPrefix > 32 {
+		c.add("tap.prefix", "%d is not between 1 and 32", *tapPrefix)
+	}
+	if *tapPrefix6 < 1 || *tapPrefix6 > 128 {
+		c.add("tap.prefix6", "%d is not between 1 and 128", *tapPrefix6)
+	}
+	for _, route := range tapRoutes() {
+		if _, _, err := net.ParseCIDR(route); err != nil && route != "default" {
+			c.add("tap.routes", "%q is not a network", route)
+		}
+	}
+
+	c.oneOf("transport", *transportName, "ssh", "shadowsocks")
+	if *transportName == "shadowsocks" {
+		if _, _, err := parseHostPort(*shadowsocksLocal); err != nil {
+			c.add("shadowsocks.local", "%v", err)
+		}
+	}
+	c.positive("udpTimeout", *udpTimeout)
+	c.positive("udpMaxFlows", *udpMaxFlows)
+	c.positive("checkTimeout", *checkTimeout)
+	c.positive("checkInterval", *checkInterval)
+
+	c.binary("ssh", *sshbin, false)
+	c.binary("ssh-keygen", *sshKeygen, false)
+	if runtime.GOOS == "linux" {
+		// only needed by the tap command
+		c.binary("ip", *ipbin, true)
+	}
+	return c.problems
+}
+
+// lineOptions returns the option set on each line of the config file, ""
+// for the other lines.
+func lineOptions(lines []string) []string {
+	options := make([]string, len(lines))
+	section := ""
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			if end := strings.Index(line, "]"); end > 0 {
+				section = strings.TrimSpace(line[1:end]) + "."
+			}
+			continue
+		}
+		if eq := strings.Index(line, "="); eq > 0 {
+			options[i] = section + strings.TrimSpace(line[:eq])
+		}
+	}
+	return options
+}
+
+// optionLine returns the line of the config file setting the option, 0 if
+// it is not set there.
+func optionLine(lines []string, option string) int {
+	for i, name := range lineOptions(lines) {
+		if name != "" && name == option {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// errorPosition is the position of a parse error, at the line of the option
+// it names if the file sets one.
+func errorPosition(path string, lines []string, err error) string {
+	option, line := "", 0
+	for i, name := range lineOptions(lines) {
+		if name != "" && strings.Contains(err.Error(), name) && len(name) > len(option) {
+			option, line = name, i+1
+		}
+	}
+	if line > 0 {
+		return fmt.Sprintf("%s:%d", path, line)
+	}
+	return path
+}
+
+// checkConfigFile is --check-config, printing every problem of the config
+// file as path:line: and exiting.
+func checkConfigFile() {
+	declareHops(cfgFile)
+	declareProfiles(cfgFile)
+	lines, _ := readLines(cfgFile)
+	if err := config.Parse(cfgFile); err != nil {
+		fail(exitConfig, "%s: error: %v", errorPosition(cfgFile, lines, err), err)
+	}
+	if usr, err := user.Current(); err == nil {
+		homeDir = usr.HomeDir
+	}
+
+	problems := configProblems()
+	sort.SliceStable(problems, func(i, j int) bool {
+		return optionLine(lines, problems[i].Option) < optionLine(lines, problems[j].Option)
+	})
+	var report []string
+	errors := 0
+	for _, p := range problems {
+		position := cfgFile
+		if line := optionLine(lines, p.Option); line > 0 {
+			position = fmt.Sprintf("%s:%d", cfgFile, line)
+		}
+		kind := "error"
+		if p.Warning {
+			kind = "warning"
+		} else {
+			errors++
+		}
+		report = append(report, fmt.Sprintf("%s: %s: %s: %s", position, kind, p.Option, p.Problem))
+		if !jsonOutput() {
+			fmt.Fprintln(os.Stderr, report[len(report)-1])
+		}
+	}
+	if errors > 0 {
+		failResult(exitConfig, Result{Problems: report}, "%s: %d errors", cfgFile, errors)
+	}
+	say("%s: OK\n", cfgFile)
+	done(Result{Problems: report})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorPosition(t *testing.T) {
+	lines := []string{
+		"proxyServerAddr=\"proxy\"",
+		"",
+		"[proxy]",
+		"port=x",
+		"[hop.1]",
+		"host=\"jump\"",
+		"hostport=22",
+	}
+	tests := []struct {
+		name string
+		err  string
+		want string
+	}{
+		{"top level option", "invalid value for proxyServerAddr", "trr.cfg:1"},
+		{"option of a section", "proxy.port: parse error", "trr.cfg:4"},
+		{"longest option named", "hop.1.hostport: no such option", "trr.cfg:7"},
+		{"option not in the file", "socksport: wrong type", "trr.cfg"},
+		{"no option", "bad line \"[proxy\"", "trr.cfg"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorPosition("trr.cfg", lines, errors.New(test.err)); got != test.want {
+				t.Errorf("errorPosition(%q) = %s, want %s", test.err, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Command is one subcommand of the Client, e.g. "forward 8080:host:80".
+type Command struct {
+	Name     string
+	Args     string
+	Summary  string
+	Help     string
+	MinArgs  int
+	MaxArgs  int // -1 for any number
+	NoConfig bool
+	Validate func(args []string) error
+	Run      func(args []string)
+	Complete []string
+}
+
+var commands []*Command
+
+// dashArgs are the arguments given after "--", also the last ones of the
+// command.
+var dashArgs []string
+
+func init() {
+	commands = []*Command{
+		{Name: "help", Args: "[command]", Summary: "Show help for the Client or a command", MaxArgs: 1, NoConfig: true,
+			Run: helpCommand},
+		{Name: "attach", Summary: "Attach to the proxy",
+			Help: "Starts the ssh master connection to the proxy through the configured hops.\nWith -s a SOCKS server is started on the first free port from proxy.socksStart,\nwith --http an HTTP proxy on the first free port from proxy.httpStart.",
+			Run:  attachCommand},
+		{Name: "detach", Summary: "Detach from the proxy",
+			Help: "Stops the ssh master connection, which closes every tunnel of the instance.",
+			Run:  detachCommand},
+		{Name: "config", Summary: "Show configuration, attach status and tunnels",
+			Run: configCommand},
+		{Name: "forward", Args: "<local port:host:remote port>", Summary: "Forward a local port to host:port behind the proxy",
+			Help:    "Listens on the local port and forwards every connection to host:port as seen\nfrom the proxy. IPv6 hosts are written in brackets, e.g. 8080:[fd00::1]:80.\nEither end may be the absolute path of a Unix socket instead, e.g.\n2375:/var/run/docker.sock or /tmp/pg.sock:db:5432. The local port may be\npreceded by the address to listen on, e.g. [::1]:8080:host:80, which defaults\nto --bind. Addresses other than loopback need --allow-public.",
+			MinArgs: 1, MaxArgs: 1, Validate: validateTunnelSpec, Run: forwardCommand},
+		{Name: "remote", Args: "<remote port:host:local port>", Summary: "Forward a port on the proxy to host:port on this side",
+			Help:    "Listens on the port on the proxy and forwards every connection to host:port as\nseen from here. Either end may be the absolute path of a Unix socket instead.",
+			MinArgs: 1, MaxArgs: 1, Validate: validateTunnelSpec, Run: remoteCommand},
+		{Name: "autoforward", Args: "<host:remote port | socket>", Summary: "Forward the first free local port to host:port",
+			Help:    "Like forward, but the local port is picked among the free ones from portStart\nto portEnd, sequentially or at random as set by portStrategy. The port last used\nfor host:port is tried first. With -q only the port is printed.",
+			MinArgs: 1, MaxArgs: 1, Validate: validateTarget, Run: autoforwardCommand},
+		{Name: "autoremote", Args: "<host:local port | socket>", Summary: "Forward a free port on the proxy to host:port on this side",
+			Help:    "Like remote, but the port on the proxy is picked among the ones from portStart\nto portEnd not listening there. With -q only the port is printed. The old\n<remote port:host> argument is refused, use remote for a given port.",
+			MinArgs: 1, MaxArgs: 1, Validate: validateAutoremote, Run: autoremoteCommand},
+		{Name: "forward-udp", Args: "<local port:host:remote port>", Summary: "Forward a local UDP port to host:port behind the proxy",
+			Help:    "Datagrams to the local port are carried through the transport to host:port,\none flow per sender, closed after udpTimeout seconds without traffic. The\ntunnel is served by a daemon unless --foreground is given.",
+			MinArgs: 1, MaxArgs: 1, Validate: validateUDPSpec, Run: forwardUDPCommand},
+		{Name: "remote-udp", Args: "<remote port:host:local port>", Summary: "Forward a UDP port on the proxy to host:port on this side",
+			Help:    "Datagrams to the port on the proxy are carried back to host:port, one flow per\nsender. Needs the ssh transport and the Client installed on the proxy as\nremoteclient. The tunnel is served by a daemon unless --foreground is given.",
+			MinArgs: 1, MaxArgs: 1, Validate: validateUDPSpec, Run: remoteUDPCommand},
+		{Name: "tap", Args: "[device]", Summary: "Route raw IP over a tap bridged to the Server",
+			Help:    "Allocates a tap on the Server, creates the local tap device with the allocated\naddress and routes to tap.routes, and bridges the two over the transport so\nthat every protocol, e.g. ICMP, SCTP or GRE, passes. Needs root or\nCAP_NET_ADMIN. Served by a daemon unless --foreground is given.",
+			MaxArgs: 1, Run: tapCommand},
+		{Name: "socks", Args: "[port]", Summary: "Serve SOCKS5 through the tunnel in the foreground",
+			Help:    "Serves SOCKS5 with CONNECT and UDP ASSOCIATE on the port, or the first free one\nfrom proxy.socksStart, dialing through the transport. With proxy.socksUser set\nclients must authenticate. attach -s starts it in the background when\nproxy.socksBuiltin is set or the transport is not ssh.",
+			MaxArgs: 1, Validate: validateOptionalPort, Run: socksCommand},
+		{Name: "http-proxy", Args: "[port]", Summary: "Serve an HTTP CONNECT proxy through the tunnel in the foreground",
+			Help:    "Serves an HTTP proxy on the port, or the first free one from proxy.httpStart to\nproxy.httpEnd, for tools using HTTP_PROXY and HTTPS_PROXY. attach --http\nstarts it in the background.",
+			MaxArgs: 1, Validate: validateOptionalPort, Run: httpProxyCommand},
+		{Name: "udprelay", Args: "<host:port>", Summary: "Relay UDP for a tunnel, run on the proxy by the Client",
+			MinArgs: 1, MaxArgs: 1, NoConfig: true, Validate: validateHostPort, Run: udprelayCommand},
+		{Name: "udplisten", Args: "<port>", Summary: "Listen for remote-udp, run on the proxy by the Client",
+			MinArgs: 1, MaxArgs: 1, NoConfig: true, Validate: validateOptionalPort, Run: udplistenCommand},
+		{Name: "reconnect", Summary: "Re-attach and restore the recorded tunnels",
+			Help: "Re-attaches after the master connection died and replays every forward,\nremote and SOCKS server of the tunnel list with the same ports. Tunnels that\ncould not be restored are listed and the exit code is 1.",
+			Run:  reconnectCommand},
+		{Name: "check", Summary: "Probe the master connection and every tunnel",
+			Help:    "Times a round trip through the master connection and probes each recorded\ntunnel: its local end is connected to and, for forwards, held open until the\nfar end answers or refuses. Tunnels are reported up, down or unreachable with\ntheir latency. The exit code is 8 if any tunnel is not up.",
+			MaxArgs: 0, Run: checkCommand},
+		{Name: "agent", Args: "[seconds]", Summary: "Keep the tunnels up, rebuilding the ones that die",
+			Help:    "Checks every checkInterval seconds, or as given. A dead master connection is\nreconnected with all its tunnels, tunnels found down are rebuilt. Served by a\ndaemon, logging to the instance log, unless --foreground is given. Stopped by\ndetach.",
+			MaxArgs: 1, Validate: validateInterval, Run: agentCommand},
+		{Name: "trust", Args: "[host]", Summary: "Trust the host keys presented now on the route to the proxy",
+			Help:    "Host keys are kept in the known_hosts file of TRR. A new host is trusted on\nfirst use unless its fingerprint is pinned in the config, a changed key fails\nthe attach. trust connects to every hop and the proxy, or only to host, and\nreplaces the keys known for them with the ones presented, printing their\nfingerprints. A pinned host is only trusted with the pinned key.",
+			MaxArgs: 1, Run: trustCommand},
+		{Name: "apply", Args: "<manifest>", Summary: "Make the tunnels those of a manifest",
+			Help:    "The manifest lists the wanted tunnels as TOML sections, [tunnel.<name>] or\n[profile.<name>.tunnel.<name>] for the profile selected with -p:\n\n  [tunnel.web]\n  type = \"autoforward\"\n  spec = \"web:80\"\n\ntype is forward, autoforward, remote, autoremote, socks, http-proxy,\nforward-udp, remote-udp or tap, and spec its argument. apply attaches if\nneeded, creates the tunnels missing and removes the ones not listed. The plan\nis printed first, with --dry-run nothing else is done.",
+			MinArgs: 1, MaxArgs: 1, Run: applyCommand},
+		{Name: "env", Args: "[shell|dotenv|json]", Summary: "Print the ports of the tunnels as environment variables",
+			Help:    "Prints <NAME>_PORT and <NAME>_HOST, or <NAME>_SOCKET, for every active tunnel,\nnamed with --name when it was set up or in the manifest, or else after where\nit leads, e.g. FORWARD_WEB_80. SOCKS and HTTP proxies also set ALL_PROXY,\nHTTP_PROXY and HTTPS_PROXY. The shell form can be sourced:\n\n  eval \"$(trr env)\"",
+			MaxArgs: 1, Validate: validateEnvFormat, Run: envCommand},
+		{Name: "run", Args: "[[name=]type[:spec] | @manifest]... -- <command> [arguments]", Summary: "Run a command with tunnels set up for it",
+			Help:    "Attaches if needed, sets up the tunnels given, e.g. web=autoforward:web:80 or\nsocks, or those of a manifest as for apply, and runs the command with the\nvariables of env added to its environment. When it exits the tunnels set up\nfor it are taken down, and the proxy detached if run attached it. The exit\ncode is the one of the command.",
+			MinArgs: 1, MaxArgs: -1, Validate: validateRun, Run: runCommandUnderTunnels},
+		{Name: "gc", Summary: "Clean up the state of dead master connections",
+			Help:    "Looks at every instance of the user on this host. Where the master connection\nis dead, its control socket and tunnel list are removed and the daemons still\nserving its tunnels are stopped. Lock files in lockdir nobody holds are\nremoved too. Instances busy with attach, detach or reconnect are left alone.",
+			MaxArgs: 0, Run: gcCommand},
+		{Name: "route", Summary: "Show the chain of hops to the proxy",
+			Run: routeCommand},
+		{Name: "profiles", Summary: "List the profiles with attach status and tunnels",
+			Run: profilesCommand},
+		{Name: "completion", Args: "<bash|zsh|fish>", Summary: "Print a shell completion script",
+			Help:    "Prints a completion script for the shell, e.g.\n  source <(" + programName() + " completion bash)",
+			MinArgs: 1, MaxArgs: 1, NoConfig: true, Run: completionCommand, Complete: []string{"bash", "zsh", "fish"}},
+	}
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func findCommand(name string) *Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printCommands(w io.Writer) {
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-42s %s\n", strings.TrimSpace(c.Name+" "+c.Args), c.Summary)
+	}
+}
+
+func commandUsage(c *Command) {
+	fmt.Fprintf(os.Stderr, "Usage: %s %s [flags]\n\n%s\n", programName(), strings.TrimSpace(c.Name+" "+c.Args), c.Summary)
+	if c.Help != "" {
+		fmt.Fprintf(os.Stderr, "\n%s\n", c.Help)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// parseCommandLine parses the flags wherever they are on the command line
+// and returns the remaining arguments. Everything after "--" is an argument.
+func parseCommandLine(flags *flag.FlagSet, arguments []string) ([]string, error) {
+	var flagArgs, args []string
+	for i := 0; i < len(arguments); i++ {
+		arg := arguments[i]
+		if arg == "--" {
+			dashArgs = arguments[i+1:]
+			args = append(args, dashArgs...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			args = append(args, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "h" || name == "help" {
+			bHelp = true
+			continue
+		}
+		flagArgs = append(flagArgs, arg)
+		if strings.Contains(name, "=") {
+			continue
+		}
+		f := flags.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown flag: %s", arg)
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		if i+1 == len(arguments) {
+			return nil, fmt.Errorf("flag needs an argument: %s", arg)
+		}
+		i++
+		flagArgs = append(flagArgs, arguments[i])
+	}
+	if err := flags.Parse(flagArgs); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// runCommand validates the arguments of the named command and runs it. The
+// returned value is the exit code when the command does not exit by itself.
+// Failures exit through fail with the code of their class.
+func runCommand(name string, args []string) int {
+	c := findCommand(name)
+	if c == nil {
+		fail(exitUsage, "Unknown command: %s", name)
+	}
+	if bHelp {
+		commandUsage(c)
+		return exitOK
+	}
+	if len(args) < c.MinArgs || c.MaxArgs >= 0 && len(args) > c.MaxArgs {
+		if !jsonOutput() && !bQuiet {
+			commandUsage(c)
+		}
+		fail(exitUsage, "Wrong number of arguments for %s", c.Name)
+	}
+	if c.Validate != nil {
+		if err := c.Validate(args); err != nil {
+			fail(exitUsage, "%s: %v", c.Name, err)
+		}
+	}
+	if !c.NoConfig {
+		setup()
+	}
+	c.Run(args)
+	return exitOK
+}
+
+func helpCommand(args []string) {
+	if len(args) == 0 {
+		Usage()
+		return
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		fail(exitUsage, "Unknown command: %s", args[0])
+	}
+	commandUsage(c)
+}
+
+func commandNames() []string {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func flagNames() []string {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) == 1 {
+			names = append(names, "-"+f.Name)
+		} else {
+			names = append(names, "--"+f.Name)
+		}
+	})
+	sort.Strings(names)
+	return append(names, "--help")
+}
+
+func completionCommand(args []string) {
+	prog := programName()
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(prog)
+
+	switch args[0] {
+	case "bash":
+		fmt.Printf("%s() {\n", fn)
+		fmt.Printf("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" cmd=\"\" i\n")
+		fmt.Printf("\tcase \"$prev\" in\n")
+		fmt.Printf("\t-c|--config) COMPREPLY=($(compgen -f -- \"$cur\")); return;;\n")
+		fmt.Printf("\t-p|--profile) COMPREPLY=($(compgen -W \"$(%s profiles -q 2>/dev/null | cut -d' ' -f1 | grep -v '^(')\" -- \"$cur\")); return;;\n", prog)
+		fmt.Printf("\tesac\n")
+		fmt.Printf("\tif [[ \"$cur\" == -* ]]; then\n\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return\n\tfi\n", strings.Join(flagNames(), " "))
+		fmt.Printf("\tfor ((i=1; i<COMP_CWORD; i++)); do\n\t\tcase \"${COMP_WORDS[i]}\" in -c|--config|-p|--profile|-e) ((i++));; -*) ;; *) cmd=\"${COMP_WORDS[i]}\"; break;; esac\n\tdone\n")
+		fmt.Printf("\tcase \"$cmd\" in\n")
+		fmt.Printf("\t\"\") COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"));;\n", strings.Join(commandNames(), " "))
+		fmt.Printf("\thelp) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"));;\n", strings.Join(commandNames(), " "))
+		for _, c := range commands {
+			if len(c.Complete) > 0 {
+				fmt.Printf("\t%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"));;\n", c.Name, strings.Join(c.Complete, " "))
+			}
+		}
+		fmt.Printf("\tesac\n}\ncomplete -F %s %s\n", fn, prog)
+	case "zsh":
+		fmt.Printf("#compdef %s\n\n%s() {\n\tlocal -a cmds\n\tcmds=(\n", prog, fn)
+		for _, c := range commands {
+			fmt.Printf("\t\t'%s:%s'\n", c.Name, strings.Replace(c.Summary, "'", "'\\''", -1))
+		}
+		fmt.Printf("\t)\n\t_arguments -C \\\n")
+		fmt.Printf("\t\t'(-c --config)'{-c,--config}'[config file]:file:_files' \\\n")
+		fmt.Printf("\t\t'(-p --profile)'{-p,--profile}'[profile]:profile:($(%s profiles -q 2>/dev/null | cut -d\" \" -f1 | grep -v \"^(\"))' \\\n", prog)
+		fmt.Printf("\t\t'(-s --socks)'{-s,--socks}'[enable SOCKS server on attach]' \\\n")
+		fmt.Printf("\t\t'--http[enable HTTP proxy on attach]' \\\n")
+		fmt.Printf("\t\t'--foreground[serve UDP tunnels in the foreground]' \\\n")
+		fmt.Printf("\t\t'(-q --quiet)'{-q,--quiet}'[quiet, for scripts]' \\\n")
+		fmt.Printf("\t\t'1:command:->cmd' \\\n\t\t'*::arg:->args'\n")
+		fmt.Printf("\tcase $state in\n\tcmd) _describe command cmds;;\n\targs)\n\t\tcase $words[1] in\n")
+		fmt.Printf("\t\thelp) _describe command cmds;;\n")
+		for _, c := range commands {
+			if len(c.Complete) > 0 {
+				fmt.Printf("\t\t%s) compadd %s;;\n", c.Name, strings.Join(c.Complete, " "))
+			}
+		}
+		fmt.Printf("\t\tesac;;\n\tesac\n}\n\n%s \"$@\"\n", fn)
+	case "fish":
+		fmt.Printf("complete -c %s -f\n", prog)
+		fmt.Printf("complete -c %s -s c -l config -r -F -d 'Config file'\n", prog)
+		fmt.Printf("complete -c %s -s p -l profile -x -a '(%s profiles -q 2>/dev/null | string match -v -r \"^\\\\(\" | string split -f1 \" \")' -d 'Profile'\n", prog, prog)
+		fmt.Printf("complete -c %s -s s -l socks -d 'Enable SOCKS server on attach'\n", prog)
+		fmt.Printf("complete -c %s -l http -d 'Enable HTTP proxy on attach'\n", prog)
+		fmt.Printf("complete -c %s -l foreground -d 'Serve UDP tunnels in the foreground'\n", prog)
+		fmt.Printf("complete -c %s -s q -l quiet -d 'Quiet, for scripts'\n", prog)
+		for _, c := range commands {
+			fmt.Printf("complete -c %s -n __fish_use_subcommand -a %s -d '%s'\n", prog, c.Name, strings.Replace(c.Summary, "'", "\\'", -1))
+		}
+		fmt.Printf("complete -c %s -n '__fish_seen_subcommand_from help' -a '%s'\n", prog, strings.Join(commandNames(), " "))
+		for _, c := range commands {
+			if len(c.Complete) > 0 {
+				fmt.Printf("complete -c %s -n '__fish_seen_subcommand_from %s' -a '%s'\n", prog, c.Name, strings.Join(c.Complete, " "))
+			}
+		}
+	default:
+		fail(exitUsage, "Unknown shell: %s", args[0])
+	}
+}
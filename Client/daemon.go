@@ -0,0 +1,211 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// daemonCommands maps the kind of a recorded tunnel to the command serving
+// it, for tunnels served in-process by a daemon of the Client.
+var daemonCommands = map[string]string{
+	"Socks5":     "socks",
+	"HttpProxy":  "http-proxy",
+	"ForwardUdp": "forward-udp",
+	"RemoteUdp":  "remote-udp",
+	"Tap":        "tap",
+	"Agent":      "agent",
+}
+
+// daemonTimeout is how long startDaemon waits for the daemon to be ready.
+const daemonTimeout = 30 * time.Second
+
+// selfArgs returns the flags running the Client again with the same config,
+// profile and bind address.
+func selfArgs() []string {
+	args := []string{"-c", cfgFile}
+	if profileName != "" {
+		args = append(args, "-p", profileName)
+	}
+	if bindAddr != "" {
+		args = append(args, "--bind", bindAddr)
+	}
+	if bAllowPublic {
+		args = append(args, "--allow-public")
+	}
+	return args
+}
+
+// startDaemon runs the Client again in the background with the same config
+// and profile to serve a tunnel in-process, e.g. "socks 1080". It returns
+// the pid and the text the daemon passed to daemonReady once it is serving.
+func startDaemon(arg ...string) (int, string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, "", err
+	}
+	args := append([]string{"-q", "--foreground"}, selfArgs()...)
+	args = append(args, arg...)
+
+	logFile, err := os.OpenFile(ctrlSocket+".log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, "", err
+	}
+	defer logFile.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(os.Environ(), "TRR_READY_FD=3")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, "", err
+	}
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		lines <- strings.TrimSpace(line)
+	}()
+
+	select {
+	case line := <-lines:
+		if strings.HasPrefix(line, "OK") {
+			pid := cmd.Process.Pid
+			cmd.Process.Release()
+			return pid, strings.TrimSpace(strings.TrimPrefix(line, "OK")), nil
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		if line == "" {
+			line = "exited, see " + ctrlSocket + ".log"
+		}
+		return 0, "", fmt.Errorf("%s: %s", strings.Join(arg, " "), strings.TrimPrefix(line, "FAIL "))
+	case <-time.After(daemonTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, "", fmt.Errorf("%s did not start in time", strings.Join(arg, " "))
+	}
+}
+
+// daemonReady tells the Client that started this process whether it is
+// serving, info is passed on to it. Run in the foreground it does nothing.
+func daemonReady(info string, err error) {
+	if os.Getenv("TRR_READY_FD") == "" {
+		return
+	}
+	os.Unsetenv("TRR_READY_FD")
+	f := os.NewFile(3, "ready")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	if err != nil {
+		fmt.Fprintf(f, "FAIL %v\n", err)
+	} else {
+		fmt.Fprintf(f, "OK %s\n", info)
+	}
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// isDaemon tells whether pid is still the daemon of the Client serving the
+// record, and not an unrelated process that got the pid once it was free.
+func isDaemon(pid int, record TunnelRecord) bool {
+	name, ok := daemonCommands[record.Kind]
+	if !ok || !processAlive(pid) {
+		return false
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	return daemonCmdline(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), self, name)
+}
+
+// daemonCmdline tells whether args are those startDaemon gives a daemon
+// running the command name.
+func daemonCmdline(args []string, self string, name string) bool {
+	if len(args) < 3 || filepath.Base(args[0]) != filepath.Base(self) {
+		return false
+	}
+	foreground := false
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "--foreground":
+			foreground = true
+		case foreground && arg == name:
+			return true
+		}
+	}
+	return false
+}
+
+// activeDaemon returns the record of a running daemon serving the tunnel.
+func activeDaemon(kind string, spec string) (TunnelRecord, bool) {
+	records, _ := readTunnelRecords(tunnelListFile)
+	for _, record := range records {
+		if record.Kind == kind && record.Spec == spec && isDaemon(record.Pid, record) {
+			return record, true
+		}
+	}
+	return TunnelRecord{}, false
+}
+
+// stopDaemons stops the daemons of the recorded tunnels.
+func stopDaemons(records []TunnelRecord) {
+	for _, record := range records {
+		if isDaemon(record.Pid, record) {
+			syscall.Kill(record.Pid, syscall.SIGTERM)
+		}
+	}
+}
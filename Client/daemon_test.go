@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestDaemonCmdline(t *testing.T) {
+	self := "/usr/local/bin/trr"
+	tests := []struct {
+		name    string
+		command string
+		args    []string
+		want    bool
+	}{
+		{"socks", "socks", []string{"/usr/local/bin/trr", "-q", "--foreground", "-c", "trr.cfg", "socks"}, true},
+		{"with spec", "forward-udp", []string{"trr", "-q", "--foreground", "-c", "trr.cfg", "forward-udp", "5353:dns:53"}, true},
+		{"other command", "socks", []string{"trr", "-q", "--foreground", "-c", "trr.cfg", "http-proxy"}, false},
+		{"not in the foreground", "socks", []string{"trr", "-c", "trr.cfg", "socks"}, false},
+		{"command before foreground", "socks", []string{"trr", "socks", "--foreground"}, false},
+		{"other program", "socks", []string{"/bin/sleep", "--foreground", "socks"}, false},
+		{"empty", "socks", nil, false},
+	}
+	for _, tt := range tests {
+		if got := daemonCmdline(tt.args, self, tt.command); got != tt.want {
+			t.Errorf("%s: daemonCmdline(%q, %q) = %v, want %v", tt.name, tt.args, tt.command, got, tt.want)
+		}
+	}
+}
+
+// TestHelperDaemon stands in for a daemon of the Client when run by
+// startHelperDaemon.
+func TestHelperDaemon(t *testing.T) {
+	if os.Getenv("TRR_HELPER_DAEMON") == "" {
+		t.Skip("helper process")
+	}
+	select {}
+}
+
+// startHelperDaemon runs the test binary with the command line of a daemon
+// running command, stopped when the test ends.
+func startHelperDaemon(t *testing.T, command string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperDaemon$", "--", "--foreground", command)
+	cmd.Env = append(os.Environ(), "TRR_HELPER_DAEMON=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// A recorded pid taken over by a process that is not a daemon of the Client
+// is neither stopped nor taken for the daemon, while the daemon itself is.
+func TestRecordedPidNotOurs(t *testing.T) {
+	testInstance(t)
+	other := exec.Command("sleep", "60")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		other.Process.Kill()
+		other.Wait()
+	}()
+	daemon := startHelperDaemon(t, "socks")
+
+	tests := []struct {
+		name string
+		pid  int
+		ours bool
+	}{
+		{"unrelated process", other.Process.Pid, false},
+		{"daemon", daemon.Process.Pid, true},
+	}
+	for _, test := range tests {
+		record := TunnelRecord{Kind: "Socks5", Spec: "1080", Pid: test.pid}
+		if err := writeTunnelRecords(tunnelListFile, []TunnelRecord{record}); err != nil {
+			t.Fatal(err)
+		}
+		if _, active := activeDaemon("Socks5", "1080"); active != test.ours {
+			t.Errorf("%s: activeDaemon = %v, want %v", test.name, active, test.ours)
+		}
+		if health := checkTunnel(record, nil); (health.Error == "daemon not running") == test.ours {
+			t.Errorf("%s: checkTunnel = %s", test.name, health)
+		}
+		if err := removeTunnel(record); err != nil {
+			t.Errorf("%s: removeTunnel: %v", test.name, err)
+		}
+		stopDaemons([]TunnelRecord{record})
+		if !test.ours && !processAlive(test.pid) {
+			t.Errorf("%s: stopped", test.name)
+		}
+	}
+	if !exited(daemon) {
+		t.Errorf("daemon not stopped")
+	}
+}
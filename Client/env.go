@@ -0,0 +1,149 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var tunnelNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// envName makes a variable name of s, e.g. "web-1" -> "WEB_1".
+func envName(s string) string {
+	b := []byte(strings.ToUpper(s))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "T_" + string(b)
+	}
+	return string(b)
+}
+
+// recordName is the name of a tunnel for env, the one it was given or one
+// made from what it leads to, e.g. FORWARD_WEB_80.
+func recordName(r TunnelRecord) string {
+	if r.Name != "" {
+		return envName(r.Name)
+	}
+	switch r.Kind {
+	case "SOCKS", "Socks5":
+		return "SOCKS"
+	case "HttpProxy":
+		return "HTTP_PROXY"
+	case "Tap":
+		return "TAP"
+	}
+	if spec, err := parseTunnelSpec(r.Spec); err == nil {
+		return envName(r.Kind + "_" + strings.TrimPrefix(spec.Target(), "/"))
+	}
+	return envName(r.Kind + "_" + r.Spec)
+}
+
+// tunnelEnv returns the variables describing the tunnels: <NAME>_PORT and
+// <NAME>_HOST for a port, <NAME>_SOCKET for a Unix socket, the port on the
+// proxy for remote tunnels. The SOCKS and HTTP proxies also set the proxy
+// variables honoured by most tools.
+func tunnelEnv(records []TunnelRecord) map[string]string {
+	env := map[string]string{}
+	for _, r := range records {
+		name := recordName(r)
+		switch r.Kind {
+		case "SOCKS", "Socks5":
+			env[name+"_PORT"] = r.Spec
+			env[name+"_HOST"] = "127.0.0.1"
+			env["ALL_PROXY"] = "socks5h://127.0.0.1:" + r.Spec
+			env["all_proxy"] = env["ALL_PROXY"]
+		case "HttpProxy":
+			env[name+"_PORT"] = r.Spec
+			env[name+"_HOST"] = "127.0.0.1"
+			for _, v := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+				env[v] = "http://127.0.0.1:" + r.Spec
+			}
+		case "Tap":
+			env[name+"_DEVICE"] = r.Spec
+		case "Agent":
+		default:
+			spec, err := parseTunnelSpec(r.Spec)
+			if err != nil {
+				continue
+			}
+			if spec.Socket != "" {
+				env[name+"_SOCKET"] = spec.Socket
+				continue
+			}
+			env[name+"_PORT"] = fmt.Sprint(spec.Port)
+			if r.Kind == "Remote" || r.Kind == "RemoteUdp" {
+				env[name+"_HOST"] = *proxyServerAddr
+			} else {
+				env[name+"_HOST"] = spec.Bind
+				if spec.Bind == "" || spec.Bind == "localhost" || spec.Bind == "*" {
+					env[name+"_HOST"] = "127.0.0.1"
+				}
+			}
+		}
+	}
+	return env
+}
+
+func envNames(env map[string]string) []string {
+	var names []string
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// formatEnv writes the variables for a shell to source, or as a dotenv file.
+func formatEnv(env map[string]string, format string) string {
+	var b strings.Builder
+	for _, name := range envNames(env) {
+		switch format {
+		case "dotenv":
+			fmt.Fprintf(&b, "%s=%s\n", name, env[name])
+		default:
+			fmt.Fprintf(&b, "export %s=%s\n", name, shellQuote(env[name]))
+		}
+	}
+	return b.String()
+}
+
+func validateEnvFormat(args []string) error {
+	if len(args) == 1 && args[0] != "shell" && args[0] != "dotenv" && args[0] != "json" {
+		return fmt.Errorf("unknown format %s, use shell, dotenv or json", args[0])
+	}
+	return nil
+}
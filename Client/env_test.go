@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"web", "WEB"},
+		{"web-1", "WEB_1"},
+		{"Forward_web_80", "FORWARD_WEB_80"},
+		{"db.internal:5432", "DB_INTERNAL_5432"},
+		{"8080", "T_8080"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := envName(test.in); got != test.want {
+			t.Errorf("envName(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestTunnelEnv(t *testing.T) {
+	*proxyServerAddr = "proxy.example"
+	tests := []struct {
+		name    string
+		records []TunnelRecord
+		want    map[string]string
+	}{
+		{"named forward",
+			[]TunnelRecord{{Kind: "Forward", Spec: "8080:web:80", Name: "web"}},
+			map[string]string{"WEB_PORT": "8080", "WEB_HOST": "127.0.0.1"}},
+		{"unnamed forward bound",
+			[]TunnelRecord{{Kind: "Forward", Spec: "[::1]:8080:web:80"}},
+			map[string]string{"FORWARD_WEB_80_PORT": "8080", "FORWARD_WEB_80_HOST": "::1"}},
+		{"socket",
+			[]TunnelRecord{{Kind: "Forward", Spec: "/tmp/pg.sock:db:5432", Name: "pg"}},
+			map[string]string{"PG_SOCKET": "/tmp/pg.sock"}},
+		{"remote",
+			[]TunnelRecord{{Kind: "Remote", Spec: "2222:localhost:22"}},
+			map[string]string{"REMOTE_LOCALHOST_22_PORT": "2222", "REMOTE_LOCALHOST_22_HOST": "proxy.example"}},
+		{"socks",
+			[]TunnelRecord{{Kind: "Socks5", Spec: "1080", Pid: 9}},
+			map[string]string{"SOCKS_PORT": "1080", "SOCKS_HOST": "127.0.0.1",
+				"ALL_PROXY": "socks5h://127.0.0.1:1080", "all_proxy": "socks5h://127.0.0.1:1080"}},
+		{"http proxy",
+			[]TunnelRecord{{Kind: "HttpProxy", Spec: "3128", Pid: 9}},
+			map[string]string{"HTTP_PROXY_PORT": "3128", "HTTP_PROXY_HOST": "127.0.0.1",
+				"HTTP_PROXY": "http://127.0.0.1:3128", "HTTPS_PROXY": "http://127.0.0.1:3128",
+				"http_proxy": "http://127.0.0.1:3128", "https_proxy": "http://127.0.0.1:3128"}},
+		{"tap and agent",
+			[]TunnelRecord{{Kind: "Tap", Spec: "tap0", Pid: 3}, {Kind: "Agent", Spec: "30", Pid: 4}},
+			map[string]string{"TAP_DEVICE": "tap0"}},
+		{"bad spec skipped",
+			[]TunnelRecord{{Kind: "Forward", Spec: "garbage"}},
+			map[string]string{}},
+	}
+	for _, test := range tests {
+		if got := tunnelEnv(test.records); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: tunnelEnv = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatEnv(t *testing.T) {
+	env := map[string]string{"WEB_PORT": "8080", "B": "it's"}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"shell", "export B='it'\\''s'\nexport WEB_PORT='8080'\n"},
+		{"dotenv", "B=it's\nWEB_PORT=8080\n"},
+	}
+	for _, test := range tests {
+		if got := formatEnv(env, test.format); got != test.want {
+			t.Errorf("formatEnv(%s) = %q, want %q", test.format, got, test.want)
+		}
+	}
+	if got := formatEnv(map[string]string{}, "shell"); got != "" {
+		t.Errorf("formatEnv of nothing = %q", got)
+	}
+}
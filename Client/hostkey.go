@@ -0,0 +1,201 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Host keys are checked against the known_hosts file of TRR rather than the
+// one of the user. An unknown host is trusted on first use, unless its key
+// is pinned by a fingerprint in the config file. A changed key fails the
+// attach until it is accepted with the trust command.
+
+// knownHostName is how ssh names the hop in known_hosts.
+func knownHostName(h Hop) string {
+	if h.Port == 22 {
+		return h.Host
+	}
+	return fmt.Sprintf("[%s]:%d", h.Host, h.Port)
+}
+
+// parseFingerprints returns the SHA256 fingerprints in ssh-keygen -l output.
+func parseFingerprints(output []byte) []string {
+	var fingerprints []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "SHA256:") {
+				fingerprints = append(fingerprints, field)
+			}
+		}
+	}
+	return fingerprints
+}
+
+// knownFingerprints returns the fingerprints of the keys known for the hop.
+func knownFingerprints(h Hop) []string {
+	output, _ := exec.Command(*sshKeygen, "-l", "-F", knownHostName(h), "-f", knownHostsFile).Output()
+	return parseFingerprints(output)
+}
+
+// hostKeyTypes are the types of host key, each with the algorithms ssh
+// negotiates for it. A pinned hop is scanned for each type in turn, as the
+// pinned key need not be the one ssh negotiates by default.
+var hostKeyTypes = []struct {
+	name       string
+	algorithms string
+}{
+	{"ED25519", "ssh-ed25519"},
+	{"ECDSA", "ecdsa-sha2-nistp256,ecdsa-sha2-nistp384,ecdsa-sha2-nistp521"},
+	{"RSA", "rsa-sha2-512,rsa-sha2-256,ssh-rsa"},
+}
+
+// scanHostKey connects to the hop, through the hops before it, only to learn
+// its host key, of the given algorithms or of the one negotiated for none.
+// It returns the known_hosts lines and their fingerprints.
+func scanHostKey(h Hop, algorithms string) ([]byte, []string, error) {
+	tmp, err := ioutil.TempFile("", "trr-known-hosts")
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// the key is written by accept-new before authentication, which need not
+	// succeed
+	var stderr bytes.Buffer
+	args := []string{"-o", "UserKnownHostsFile=" + tmp.Name(), "-o", "GlobalKnownHostsFile=/dev/null",
+		"-o", "StrictHostKeyChecking=accept-new", "-o", "BatchMode=yes", "-o", "ControlPath=none",
+		"-o", "ConnectTimeout=30"}
+	if algorithms != "" {
+		args = append(args, "-o", "HostKeyAlgorithms="+algorithms)
+	}
+	cmd := sshCommand(append(args, h.Name, "exit")...)
+	cmd.Stderr = &stderr
+	cmd.Run()
+
+	lines, err := ioutil.ReadFile(tmp.Name())
+	if err != nil || len(lines) == 0 {
+		return nil, nil, fmt.Errorf("no host key from %s: %s", h, strings.TrimSpace(stderr.String()))
+	}
+	output, err := exec.Command(*sshKeygen, "-l", "-f", tmp.Name()).Output()
+	if err != nil {
+		return nil, nil, err
+	}
+	return lines, parseFingerprints(output), nil
+}
+
+// scanPinnedKey scans the hop for each type of host key until it presents
+// the pinned one. The known_hosts lines of the pinned key are returned, or
+// the fingerprints of every key presented with their types.
+func scanPinnedKey(h Hop) ([]byte, []string, error) {
+	var presented []string
+	var firstErr error
+	for _, keyType := range hostKeyTypes {
+		lines, fingerprints, err := scanHostKey(h, keyType.algorithms)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if containsFingerprint(fingerprints, h.Fingerprint) {
+			return lines, fingerprints, nil
+		}
+		for _, f := range fingerprints {
+			presented = append(presented, keyType.name+" "+f)
+		}
+	}
+	if len(presented) == 0 {
+		return nil, nil, firstErr
+	}
+	return nil, presented, fmt.Errorf("host keys of %s are %s, none is the pinned %s", h, strings.Join(presented, ", "), h.Fingerprint)
+}
+
+func containsFingerprint(fingerprints []string, fingerprint string) bool {
+	for _, f := range fingerprints {
+		if f == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// trustHost replaces the keys known for the hop with the ones it presents
+// now. A pinned hop is only trusted with the pinned key, of whatever type.
+// The fingerprints of the new keys are returned.
+func trustHost(h Hop) ([]string, error) {
+	var lines []byte
+	var fingerprints []string
+	var err error
+	if h.Fingerprint != "" {
+		lines, fingerprints, err = scanPinnedKey(h)
+	} else {
+		lines, fingerprints, err = scanHostKey(h, "")
+	}
+	if err != nil {
+		return fingerprints, err
+	}
+
+	exec.Command(*sshKeygen, "-R", knownHostName(h), "-f", knownHostsFile).Run()
+	os.Remove(knownHostsFile + ".old")
+	f, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = f.Write(lines)
+	return fingerprints, err
+}
+
+// verifyPinnedHosts makes sure the known keys of the pinned hops match their
+// fingerprints before ssh checks them. A pinned hop not known yet is
+// scanned and added if it presents the pinned key.
+func verifyPinnedHosts() error {
+	for _, h := range hopChain() {
+		if h.Fingerprint == "" {
+			continue
+		}
+		known := knownFingerprints(h)
+		if containsFingerprint(known, h.Fingerprint) {
+			continue
+		}
+		if len(known) > 0 {
+			return fmt.Errorf("known host key of %s is %s, not the pinned %s", h, strings.Join(known, ", "), h.Fingerprint)
+		}
+		if _, err := trustHost(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeHostKeys makes ssh a script presenting an ED25519 key by default and
+// an ECDSA key when asked for one, and returns their fingerprints.
+func fakeHostKeys(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	fingerprint := func(name string, keyType string) string {
+		key := filepath.Join(dir, name)
+		if out, err := exec.Command("ssh-keygen", "-q", "-t", keyType, "-N", "", "-f", key).CombinedOutput(); err != nil {
+			t.Skipf("ssh-keygen: %v %s", err, out)
+		}
+		out, err := exec.Command("ssh-keygen", "-l", "-f", key+".pub").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseFingerprints(out)[0]
+	}
+	ed, ec := fingerprint("ed", "ed25519"), fingerprint("ec", "ecdsa")
+
+	script := fmt.Sprintf(`#!/bin/sh
+for a; do
+	case "$a" in
+	UserKnownHostsFile=*) known=${a#*=} ;;
+	HostKeyAlgorithms=*) algorithms=${a#*=} ;;
+	esac
+done
+case "$algorithms" in
+""|ssh-ed25519) key=%[1]s/ed.pub ;;
+ecdsa*) key=%[1]s/ec.pub ;;
+*) echo "no matching host key type found" >&2; exit 255 ;;
+esac
+echo "[host]:2222 $(cut -d' ' -f1,2 $key)" > "$known"
+exit 255
+`, dir)
+	*sshbin = filepath.Join(dir, "ssh")
+	if err := ioutil.WriteFile(*sshbin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	*sshKeygen = "ssh-keygen"
+	sshConfigFile = filepath.Join(dir, "config")
+	knownHostsFile = filepath.Join(dir, "known_hosts")
+	return ed, ec
+}
+
+func TestTrustHost(t *testing.T) {
+	ed, ec := fakeHostKeys(t)
+	tests := []struct {
+		name  string
+		pin   string
+		known string
+		err   string
+	}{
+		{"not pinned", "", ed, ""},
+		{"pinned negotiated key", ed, ed, ""},
+		{"pinned key of another type", ec, ec, ""},
+		{"pinned key not presented", "SHA256:none", "", "ED25519 " + ed + ", ECDSA " + ec},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := Hop{Name: "proxy", Host: "host", Port: 2222, Fingerprint: test.pin}
+			exec.Command("ssh-keygen", "-R", knownHostName(h), "-f", knownHostsFile).Run()
+			_, err := trustHost(h)
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error %v, want one naming %s", err, test.err)
+			}
+			known := knownFingerprints(h)
+			if test.known == "" && len(known) > 0 || test.known != "" && strings.Join(known, " ") != test.known {
+				t.Errorf("known keys %v, want %s", known, test.known)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The lock of an instance is a file in lockdir held with flock while attach,
+// detach or reconnect change the master connection, so that two of them do
+// not race. The kernel drops the lock when its holder dies, a lock file left
+// behind is only stale state for gc.
+
+var instanceLock *os.File
+
+// lockPath returns the lock file of the instance with the given control
+// socket. Users share lockdir, so the name holds the user too.
+func lockPath(socket string) string {
+	return filepath.Join(*lockdir, fmt.Sprintf("%s.%s.lock", userName, filepath.Base(socket)))
+}
+
+// createLockdir creates lockdir, sticky and writable by every user like
+// /tmp when it is made here.
+func createLockdir() error {
+	if err := os.MkdirAll(filepath.Dir(filepath.Clean(*lockdir)), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(*lockdir, 0755); err == nil {
+		return os.Chmod(*lockdir, 0777|os.ModeSticky)
+	} else if !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// tryLock takes the lock file at path without waiting. It returns nil and
+// the pid of the holder if the lock is taken.
+func tryLock(path string) (*os.File, int, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				pid, _ := ioutil.ReadFile(path)
+				holder, _ := strconv.Atoi(strings.TrimSpace(string(pid)))
+				return nil, holder, nil
+			}
+			return nil, 0, err
+		}
+		// gc may have removed the file between the open and the lock
+		var held, current syscall.Stat_t
+		if syscall.Fstat(int(f.Fd()), &held) == nil && syscall.Stat(path, &current) == nil &&
+			held.Ino == current.Ino && held.Dev == current.Dev {
+			f.Truncate(0)
+			f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			return f, 0, nil
+		}
+		f.Close()
+	}
+}
+
+// lockInstance takes the lock of the current instance for the rest of the
+// process, or fails the command if another one holds it.
+func lockInstance() {
+	if err := createLockdir(); err != nil {
+		fail(exitFailure, "Lock directory %s: %v", *lockdir, err)
+	}
+	f, holder, err := tryLock(lockPath(ctrlSocket))
+	if err != nil {
+		fail(exitFailure, "Lock %s: %v", lockPath(ctrlSocket), err)
+	}
+	if f == nil {
+		fail(exitBusy, "Server %s is being set up by pid %d", *proxyServerAddr, holder)
+	}
+	instanceLock = f
+}
+
+// unlockInstance releases the lock taken by lockInstance.
+func unlockInstance() {
+	if instanceLock != nil {
+		instanceLock.Close()
+		instanceLock = nil
+	}
+}
+
+// socketAlive tells if a master connection answers on the control socket.
+// The config of the instance may be gone, so plain ssh is asked.
+func socketAlive(socket string) bool {
+	return exec.Command(*sshbin, "-O", "check", "-o", "ControlPath="+socket, "trr").Run() == nil
+}
+
+// instanceSuffixes are the files of an instance next to its control socket.
+var instanceSuffixes = []string{".txt", ".config", ".ports", ".log"}
+
+// instanceBases returns the control socket paths of every instance of the
+// user on this host, found from the files left in ~/.ssh.
+func instanceBases() []string {
+	files, _ := filepath.Glob(filepath.Join(homeDir, ".ssh", "*."+hostname+".*"))
+	seen := map[string]bool{}
+	var bases []string
+	for _, file := range files {
+		base := file
+		for _, suffix := range instanceSuffixes {
+			base = strings.TrimSuffix(base, suffix)
+		}
+		if _, err := strconv.Atoi(base[strings.LastIndex(base, ".")+1:]); err != nil || seen[base] {
+			continue
+		}
+		seen[base] = true
+		bases = append(bases, base)
+	}
+	return bases
+}
+
+// instanceFiles returns the control socket and the files of the instance
+// at base.
+func instanceFiles(base string) []string {
+	files := []string{base}
+	for _, suffix := range instanceSuffixes {
+		files = append(files, base+suffix)
+	}
+	return files
+}
+
+// collectInstance removes the state of an instance whose master connection
+// is dead: the control socket, the files next to it and the daemons serving
+// its tunnels. A recorded pid is only stopped while it is still the daemon
+// of the tunnel. The removed files and stopped daemons are returned.
+func collectInstance(base string) []string {
+	var removed []string
+	if _, err := os.Stat(base); err == nil && socketAlive(base) {
+		return nil
+	}
+	found := false
+	for _, path := range instanceFiles(base) {
+		if _, err := os.Lstat(path); err == nil {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	lock, _, err := tryLock(lockPath(base))
+	if err != nil || lock == nil {
+		return nil
+	}
+	defer lock.Close()
+
+	records, _ := readTunnelRecords(base + ".txt")
+	for _, record := range records {
+		if isDaemon(record.Pid, record) {
+			syscall.Kill(record.Pid, syscall.SIGTERM)
+			removed = append(removed, fmt.Sprintf("%s (pid %d)", record, record.Pid))
+		}
+	}
+	for _, path := range instanceFiles(base) {
+		if os.Remove(path) == nil {
+			removed = append(removed, path)
+		}
+	}
+	return removed
+}
+
+// collectLocks removes the lock files of the user that nobody holds.
+func collectLocks() []string {
+	var removed []string
+	files, _ := filepath.Glob(filepath.Join(*lockdir, userName+".*.lock"))
+	for _, file := range files {
+		lock, _, err := tryLock(file)
+		if err != nil || lock == nil {
+			continue
+		}
+		if os.Remove(file) == nil {
+			removed = append(removed, file)
+		}
+		lock.Close()
+	}
+	return removed
+}
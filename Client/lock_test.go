@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// exited waits a while for cmd to end and tells whether it was stopped by
+// SIGTERM.
+func exited(cmd *exec.Cmd) bool {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+		status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		return ok && status.Signaled() && status.Signal() == syscall.SIGTERM
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+func TestCollectInstance(t *testing.T) {
+	testInstance(t)
+	daemon := startHelperDaemon(t, "socks")
+	other := exec.Command("sleep", "60")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		other.Process.Kill()
+		other.Wait()
+	}()
+
+	// the pid of the http-proxy was taken by an unrelated process since
+	records := []TunnelRecord{
+		{Kind: "Socks5", Spec: "1080", Pid: daemon.Process.Pid},
+		{Kind: "HttpProxy", Spec: "8080", Pid: other.Process.Pid},
+		{Kind: "Forward", Spec: "8022:host:22"},
+	}
+	if err := writeTunnelRecords(tunnelListFile, records); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{".config", ".ports", ".log"} {
+		if err := os.WriteFile(ctrlSocket+suffix, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed := collectInstance(ctrlSocket)
+	if len(removed) != 5 {
+		t.Errorf("removed %q, want the daemon and 4 files", removed)
+	}
+	for _, path := range instanceFiles(ctrlSocket) {
+		if _, err := os.Lstat(path); err == nil {
+			t.Errorf("%s left behind", path)
+		}
+	}
+	if !exited(daemon) {
+		t.Errorf("daemon not stopped")
+	}
+	if !processAlive(other.Process.Pid) {
+		t.Errorf("unrelated process with a recorded pid stopped")
+	}
+}
+
+func TestCollectInstanceLeftFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  int
+	}{
+		{"none", nil, 0},
+		{"config only", []string{".config"}, 1},
+		{"ports and log", []string{".ports", ".log"}, 2},
+	}
+	for _, tt := range tests {
+		testInstance(t)
+		for _, suffix := range tt.files {
+			if err := os.WriteFile(ctrlSocket+suffix, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if removed := collectInstance(ctrlSocket); len(removed) != tt.want {
+			t.Errorf("%s: removed %q, want %d files", tt.name, removed, tt.want)
+		}
+	}
+}
@@ -27,35 +27,70 @@ package main
 import (
 	"flag"
 	"os"
+	"os/exec"
 	"bufio"
 	"fmt"
 	"regexp"
 	"os/user"
-	"log"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"net"
+	"net/http"
+	"time"
+	config "github.com/stvp/go-toml-config"
 )
 
 var (
 	//	tunnels             = config.String("tunnels", "")
 	portStart          = config.Int("portStart", 10000)
 	portEnd            = config.Int("portEnd", 65535)
+	portStrategy       = config.String("portStrategy", "sequential")
+	addressFamily      = config.String("addressFamily", "any")
 	lockdir            = config.String("lockdir", "/tmp/tunnelsetup/")
 	socksStart         = config.Int("proxy.socksStart", 1080)
 	socksEnd           = config.Int("proxy.socksEnd", 10800)
 	socksActive        = config.Bool("proxy.socksActive", false)
-//	proxyServerAddr    = config.String("proxy.address", "10.0.1.136")
+	socksBuiltin       = config.Bool("proxy.socksBuiltin", false)
+	socksUser          = config.String("proxy.socksUser", "")
+	socksPassword      = config.String("proxy.socksPassword", "")
+	httpStart          = config.Int("proxy.httpStart", 3128)
+	httpEnd            = config.Int("proxy.httpEnd", 4128)
+	httpActive         = config.Bool("proxy.httpActive", false)
+	tapServer          = config.String("tap.server", "localhost:18080")
+	tapDevice          = config.String("tap.device", "trr%d")
+	tapPrefix          = config.Int("tap.prefix", 30)
+	tapPrefix6         = config.Int("tap.prefix6", 126)
+	tapRouteList       = config.String("tap.routes", "")
+	ipbin              = config.String("ip", "ip")
+	transportName      = config.String("transport", "ssh")
+	shadowsocksLocal   = config.String("shadowsocks.local", "127.0.0.1:1081")
+	remoteClient       = config.String("remoteclient", "trr-client")
+	udpTimeout         = config.Int("udpTimeout", 120)
+	udpMaxFlows        = config.Int("udpMaxFlows", 64)
+	checkTimeout       = config.Int("checkTimeout", 5)
+	checkInterval      = config.Int("checkInterval", 30)
+	proxyServerAddr    = config.String("proxy.address", "10.0.1.136")
 //	proxySSHMasterFlag = config.String("proxy.sshmasterflag", "-o \"ControlMaster=yes\" -o \"ControlPath=~/.ssh/%r@%h:%p\"")
-//	proxyUser          = config.String("proxy.user", "proxy")
+	proxyUser          = config.String("proxy.user", "proxy")
+	proxySSHPort       = config.Int("proxy.sshport", 22)
+	proxyIdentity      = config.String("proxy.identity", "")
+	proxyAuth          = config.String("proxy.auth", "")
+	proxyFingerprint   = config.String("proxy.fingerprint", "")
+	knownHosts         = config.String("knownHosts", "")
+	sshKeygen          = config.String("ssh-keygen", "ssh-keygen")
 	instance           = config.Int("instance", 0)
-//	sshbin             = config.String("ssh", "ssh")
-	tunnelbin		   = config.String("ss-tunnel")
-	clientbin		   = config.String("ss-client")
+	sshbin             = config.String("ssh", "ssh")
+	tunnelbin		   = config.String("ss-tunnel", "ss-tunnel")
+	clientbin		   = config.String("ss-client", "ss-client")
 
 )
 
 type TAPinfo struct {
 	Tap    string
 	Ip     string
+	Ip6    string
 	Port   int
 	Status string
 	Reason string
@@ -66,17 +101,44 @@ var cfgFile string
 var command string
 var ctrlSocket string
 var tunnelListFile string
+var sshConfigFile string
+var portsFile string
 var bSocks bool
+var bHTTP bool
+var bForeground bool
 var bQuiet bool
+var bAllowPublic bool
+var bDryRun bool
+var bCheckConfig bool
+var tunnelName string
+var bindAddr string
 var socksSocket int
 var userName string
+var homeDir string
+var hostname string
+var bHelp bool
+var knownHostsFile string
 
 var Usage = func() {
-	fmt.Fprintf(os.Stderr, "Usage of %s\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [arguments] [flags]\n\nCommands:\n", programName())
+	printCommands(os.Stderr)
+	fmt.Fprintf(os.Stderr, "\nRun '%s help <command>' for the details of a command.\n\nFlags:\n", programName())
 	flag.PrintDefaults()
-	fmt.Fprintf(os.Stderr, "\nConfig file:\nportStart = <first port to be used on localhost>\nportEnd = <last port to use on localhost\n[proxy]\nport = <SOCKS proxy to create on localhost. OPTIONAL (used with -s parameter)>\naddress = \"<IP address to proxy. MANDATORY>\"\n")
-	fmt.Fprintf(os.Stderr, "user=\"<proxy username. MANDATORY>\"\n")
+	fmt.Fprintf(os.Stderr, "\nExit codes:\n0 OK\n1 other failure\n2 bad command line\n3 config error\n4 not attached\n5 already attached\n6 ssh failure\n7 no free port\n8 some tunnels failed\n9 instance busy with another attach, detach or reconnect\n")
+	fmt.Fprintf(os.Stderr, "\nConfig file:\nportStart = <first port to be used on localhost>\nportEnd = <last port to use on localhost\nportStrategy = \"<sequential|random, how free ports are picked. OPTIONAL>\"\naddressFamily = \"<any|inet|inet6, the addresses forwards listen on. OPTIONAL>\"\n")
 	fmt.Fprintf(os.Stderr, "ssh=\"<ssh client with full path. Recommended if not using default ssh>\"\n")
+	fmt.Fprintf(os.Stderr, "lockdir=\"<directory of the lock files of the instances. OPTIONAL>\"\n")
+	fmt.Fprintf(os.Stderr, "knownHosts=\"<known_hosts file of TRR, ~/.ssh/trr_known_hosts by default. OPTIONAL>\"\n")
+	fmt.Fprintf(os.Stderr, "transport=\"<ssh|shadowsocks, carrying the in-process tunnels. OPTIONAL>\"\nremoteclient=\"<the Client on the proxy, relaying UDP. OPTIONAL>\"\nudpTimeout=<seconds before an idle UDP flow is closed. OPTIONAL>\nudpMaxFlows=<UDP flows, each one an ssh process, per tunnel. OPTIONAL>\ncheckTimeout=<seconds a tunnel is probed by check. OPTIONAL>\ncheckInterval=<seconds between the checks of agent. OPTIONAL>\n")
+	fmt.Fprintf(os.Stderr, "[proxy]\nport = <SOCKS proxy to create on localhost. OPTIONAL (used with -s parameter)>\naddress = \"<IP address to proxy. MANDATORY>\"\n")
+	fmt.Fprintf(os.Stderr, "user=\"<proxy username. MANDATORY>\"\n")
+	fmt.Fprintf(os.Stderr, "sshport=<ssh port of the proxy. OPTIONAL>\nidentity=\"<private key file. OPTIONAL>\"\nauth=\"<publickey|agent|password|keyboard-interactive. OPTIONAL>\"\nfingerprint=\"<SHA256:... pinned host key, otherwise trusted on first use. OPTIONAL>\"\n")
+	fmt.Fprintf(os.Stderr, "socksBuiltin=<true to serve SOCKS5 in the Client instead of ssh -D. OPTIONAL>\nsocksUser=\"<SOCKS5 username. OPTIONAL>\"\nsocksPassword=\"<SOCKS5 password. OPTIONAL>\"\n")
+	fmt.Fprintf(os.Stderr, "httpStart = <first port for the HTTP proxy. OPTIONAL>\nhttpEnd = <last port for the HTTP proxy. OPTIONAL>\nhttpActive = <true to start the HTTP proxy on attach, as -http. OPTIONAL>\n")
+	fmt.Fprintf(os.Stderr, "[shadowsocks]\nlocal=\"<address of ss-local serving SOCKS5. OPTIONAL>\"\n")
+	fmt.Fprintf(os.Stderr, "[tap]\nserver=\"<web address of the Server as seen from the proxy. OPTIONAL>\"\ndevice=\"<local tap device name. OPTIONAL>\"\nprefix=<prefix length of the allocated address. OPTIONAL>\nprefix6=<prefix length of the allocated IPv6 address, if the Server has a pool. OPTIONAL>\nroutes=\"<comma separated subnets routed over the tap. OPTIONAL>\"\n")
+	fmt.Fprintf(os.Stderr, "[hop.1]\nhost=\"<first jump host on the way to the proxy. OPTIONAL>\"\nuser=\"<username>\"\nport=<ssh port>\nidentity=\"<private key file>\"\nauth=\"<as for proxy>\"\nfingerprint=\"<as for proxy>\"\n[hop.2]\n...\n")
+	fmt.Fprintf(os.Stderr, "[profile.<name>]\naddress, user, sshport, identity, auth, fingerprint, instance, socksStart, socksEnd, socksActive as above, selected with -p <name>\n[profile.<name>.hop.1]\n...\n")
 }
 
 func readLines(path string) ([]string, error) {
@@ -110,7 +172,7 @@ func checkTunnelPresent(path string, tunnelType string, port string) bool {
 	}
 	defer file.Close()
 
-	re := regexp.MustCompile(fmt.Sprintf("%s ([0-9]+):([a-z0-9.]+):([0-9]+)", tunnelType))
+	re := regexp.MustCompile(fmt.Sprintf("%s ([0-9]+):(\\[[0-9a-fA-F:.]+\\]|[A-Za-z0-9_.-]+):([0-9]+)", tunnelType))
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
@@ -132,7 +194,7 @@ func getLocalTunnelPort(path string, tunnelType string, port string) string {
 	}
 	defer file.Close()
 
-	re := regexp.MustCompile(fmt.Sprintf("%s ([0-9]+):([a-z0-9.]+):([0-9]+)", tunnelType))
+	re := regexp.MustCompile(fmt.Sprintf("%s ([0-9]+):(\\[[0-9a-fA-F:.]+\\]|[A-Za-z0-9_.-]+):([0-9]+)", tunnelType))
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
@@ -146,6 +208,12 @@ func getLocalTunnelPort(path string, tunnelType string, port string) string {
 	return "-1"
 }
 
+// recordTunnel adds a tunnel to the tunnel list under the name given with
+// --name, if any.
+func recordTunnel(kind string, spec string, pid int) {
+	saveTunnel2Config("%s\n", TunnelRecord{kind, spec, pid, tunnelName}.String())
+}
+
 func saveTunnel2Config(templ string, arg ...string) {
 	f, err := os.OpenFile(tunnelListFile, os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
@@ -188,412 +256,906 @@ func CToGoString(c []byte) string {
 	return string(c[:n+1])
 }
 
-func main() {
-	flag.StringVar(&cfgFile, "c", "tunnels.cfg", "Tunnel config setup file")
-	flag.StringVar(&command, "e", "help", "Execute command (NOTE: must be last parameter): \n help\n attach\n detach\n config\n forward <local port:ip:remote port>\n remote <remote port:ip:local port>\n autoforward <ip:remote port>\n ")
-	flag.BoolVar(&bSocks, "s", false, "Enable SOCKS server on attach")
-	flag.BoolVar(&bQuiet, "q", false, "Quiet just print the port number. Used in scripts")
-	flag.Usage = Usage
-	flag.Parse()
+// startMaster starts the ssh ControlMaster connection to the proxy. When
+// socksPort is -1 no SOCKS server is started, otherwise the ports from
+// socksPort to lastPort are tried in turn and the one bound is returned.
+func startMaster(socksPort int, lastPort int) (int, error) {
+	if err := verifyPinnedHosts(); err != nil {
+		return -1, err
+	}
+	for {
+		var cmd *exec.Cmd
+		if socksPort > -1 {
+			cmd = sshCommand("-o", "ControlMaster=yes", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-o", "TCPKeepAlive=yes", "-o", "ServerAliveInterval=60", "-o", "ExitOnForwardFailure=yes", "-fNT", "-D", fmt.Sprintf("%d", socksPort), "-l", *proxyUser, *proxyServerAddr)
+		} else {
+			cmd = sshCommand("-o", "ControlMaster=yes", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-o", "TCPKeepAlive=yes", "-o", "ServerAliveInterval=60", "-fNT", "-l", *proxyUser, *proxyServerAddr)
+		}
+		// a file, as the master connection keeps a pipe open once in the background
+		stderr, err := ioutil.TempFile("", "trr-ssh")
+		if err != nil {
+			return -1, err
+		}
+		os.Remove(stderr.Name())
+		cmd.Stderr = stderr
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			stderr.Close()
+			return -1, err
+		}
 
-	if !bQuiet {
-		fmt.Printf("Tunnel Setup\n")
+		err = cmd.Start()
+		if err != nil {
+			stderr.Close()
+			return -1, err
+		}
+
+		go io.Copy(os.Stdout, stdout)
+
+		err = cmd.Wait()
+		stderr.Seek(0, io.SeekStart)
+		output, _ := ioutil.ReadAll(stderr)
+		stderr.Close()
+		if err == nil {
+			return socksPort, nil
+		}
+		if strings.Contains(string(output), "Host key verification failed") {
+			return -1, fmt.Errorf("host key of %s is not the trusted one, check it and run trust if it changed on purpose: %s", *proxyServerAddr, strings.TrimSpace(string(output)))
+		}
+		if socksPort < 0 || socksPort >= lastPort {
+			return -1, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+		}
+		socksPort++
+	}
+}
+
+// openTunnel adds a port forwarding to the running master connection.
+// direction is the ssh option, "-L" for forward and "-R" for remote tunnels.
+func openTunnel(direction string, spec string) error {
+	// a Unix socket left behind by an earlier master connection is replaced
+	args := []string{"-O", "forward", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), direction, spec, *proxyServerAddr,
+		"-o", "ExitOnForwardFailure=yes", "-o", "StreamLocalBindUnlink=yes"}
+
+	output, err := sshCommand(args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
 	}
+	return nil
+}
 
+// setup reads the config file and the selected profile and names the files
+// of the instance. It is run before every command that talks to the proxy.
+func setup() {
+	say("Tunnel Setup\n")
+
+	declareHops(cfgFile)
+	declareProfiles(cfgFile)
 	if err := config.Parse(cfgFile); err != nil {
-		panic(err)
+		fail(exitConfig, "Config file %s: %v", cfgFile, err)
 	}
 	usr, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		fail(exitFailure, "%v", err)
 	}
 	userName = usr.Username
+	homeDir = usr.HomeDir
 
-	hostname, err := os.Hostname()
+	hostname, err = os.Hostname()
 	if err != nil {
-		log.Fatal(err)
+		fail(exitFailure, "%v", err)
+	}
+
+	if err := selectProfile(profileName); err != nil {
+		fail(exitConfig, "%v", err)
+	}
+
+	if *portStart > *portEnd {
+		fail(exitConfig, "portStart %d > portEnd %d", *portStart, *portEnd)
+	}
+
+	switch *addressFamily {
+	case "any", "inet", "inet6":
+	default:
+		fail(exitConfig, "Unknown addressFamily %s, use any, inet or inet6", *addressFamily)
 	}
 
 	if (*socksActive) {
 		bSocks = true
 	}
+	if (*httpActive) {
+		bHTTP = true
+	}
 
-	ctrlSocket := fmt.Sprintf("%s/.ssh/%s.%s.%d", usr.HomeDir, *proxyServerAddr, hostname, *instance)
-	tunnelListFile = fmt.Sprintf("%s/.ssh/%s.%s.%d.txt", usr.HomeDir, *proxyServerAddr, hostname, *instance)
-
-
-	if command == "help" {
-		flag.PrintDefaults()
-		os.Exit(0)
-	} else if command == "attach" {
-
-		if _, err := os.Stat(ctrlSocket); err == nil {
-			cmd := exec.Command(*sshbin, "-O", "check", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr)
-
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				if !bQuiet {
-					fmt.Println(fmt.Sprint(err) + ": " + string(output))
-					os.Remove(ctrlSocket)
-					os.Remove(tunnelListFile)
-					fmt.Println("Socket connection is removed")
-				}
-			} else {
-				if bQuiet {
-					// if running quiet (ie in a script) it is assumed a new master connection is wanted each time
-					// os.Exit(0)
-					os.Remove(ctrlSocket)
-					os.Remove(tunnelListFile)
-				} else
-				{
-					fmt.Printf("Server %s already attached", *proxyServerAddr)
-					fmt.Println(string(output))
-					os.Exit(1)
-				}
-			}
+	profile, _ := resolveProfile(profileName)
+	base := profileBase(profile, homeDir, hostname)
+	ctrlSocket = base
+	tunnelListFile = base + ".txt"
+	sshConfigFile = base + ".config"
+	knownHostsFile = *knownHosts
+	if knownHostsFile == "" {
+		knownHostsFile = homeDir + "/.ssh/trr_known_hosts"
+	}
+	portsFile = base + ".ports"
 
-		}
+	if err := writeSSHConfig(sshConfigFile); err != nil {
+		fail(exitConfig, "%v", err)
+	}
+}
 
-		os.Remove(tunnelListFile)
+func main() {
+	flag.StringVar(&cfgFile, "c", "tunnels.cfg", "Tunnel config setup file")
+	flag.StringVar(&cfgFile, "config", "tunnels.cfg", "Tunnel config setup file")
+	flag.StringVar(&command, "e", "", "Execute command, old style where the argument follows the flags")
+	flag.StringVar(&profileName, "p", "", "Profile from the config file to use")
+	flag.StringVar(&profileName, "profile", "", "Profile from the config file to use")
+	flag.BoolVar(&bSocks, "s", false, "Enable SOCKS server on attach")
+	flag.BoolVar(&bSocks, "socks", false, "Enable SOCKS server on attach")
+	flag.BoolVar(&bHTTP, "http", false, "Enable HTTP CONNECT proxy on attach")
+	flag.BoolVar(&bForeground, "foreground", false, "Serve UDP tunnels in the foreground instead of in a daemon")
+	flag.BoolVar(&bQuiet, "q", false, "Quiet just print the port number. Used in scripts")
+	flag.BoolVar(&bQuiet, "quiet", false, "Quiet just print the port number. Used in scripts")
+	flag.StringVar(&outputFormat, "o", "text", "Output format, text or json")
+	flag.StringVar(&outputFormat, "output", "text", "Output format, text or json")
+	flag.StringVar(&bindAddr, "b", "", "Address the local end of tunnels listens on, e.g. ::1")
+	flag.StringVar(&bindAddr, "bind", "", "Address the local end of tunnels listens on, e.g. ::1")
+	flag.BoolVar(&bAllowPublic, "allow-public", false, "Allow tunnels to listen on addresses reachable from the network")
+	flag.BoolVar(&bDryRun, "dry-run", false, "Print what apply would change without changing it")
+	flag.StringVar(&tunnelName, "name", "", "Name of the tunnel set up, for env")
+	flag.BoolVar(&bCheckConfig, "check-config", false, "Check the config file, print its problems with their lines and exit")
+	flag.Usage = Usage
 
-		socksSocket = *socksStart
-		if (!bSocks) {
-			socksSocket = -1
+	args, err := parseCommandLine(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		Usage()
+		os.Exit(exitUsage)
+	}
+	if outputFormat != "text" && outputFormat != "json" {
+		format := outputFormat
+		outputFormat = "text"
+		fail(exitUsage, "Unknown output format %s, use text or json", format)
+	}
+	if tunnelName != "" && !tunnelNameRe.MatchString(tunnelName) {
+		fail(exitUsage, "Bad tunnel name %s, use letters, digits, - and _", tunnelName)
+	}
+	if bindAddr != "" {
+		if _, err := parseBind(strings.Trim(bindAddr, "[]")); err != nil {
+			fail(exitUsage, "%v", err)
 		}
-		var cmd *exec.Cmd
+		bindAddr = strings.Trim(bindAddr, "[]")
+		if err := checkBind(bindAddr); err != nil {
+			fail(exitUsage, "%v", err)
+		}
+	}
+	if bCheckConfig {
+		checkConfigFile()
+	}
+	if command == "" {
+		command = "help"
+		if len(args) > 0 {
+			command, args = args[0], args[1:]
+		}
+	}
 
+	os.Exit(runCommand(command, args))
+}
 
-	retryMaster:
+// requireAttached fails the command unless the master connection is up.
+func requireAttached() {
+	if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
+		fail(exitNotAttached, "Server %s is not attached", *proxyServerAddr)
+	}
+}
 
-		if bSocks {
-			cmd = exec.Command(*sshbin, "-o", "ControlMaster=yes", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-o", "TCPKeepAlive=yes", "-o", "ServerAliveInterval=60",  "-o", "StrictHostKeyChecking=no", "-o", "ExitOnForwardFailure=yes", "-fNT", "-D", fmt.Sprintf("%d", socksSocket), "-l", *proxyUser, *proxyServerAddr)
+func attachCommand(args []string) {
+	lockInstance()
 
-		} else {
-			cmd = exec.Command(*sshbin, "-o", "ControlMaster=yes", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-o", "TCPKeepAlive=yes", "-o", "ServerAliveInterval=60", "-o", "StrictHostKeyChecking=no", "-fNT", "-l", *proxyUser, *proxyServerAddr)
+	if _, err := os.Stat(ctrlSocket); err == nil {
+		cmd := sshCommand("-O", "check", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr)
 
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			say("%v: %s", err, output)
+			os.Remove(ctrlSocket)
+			os.Remove(tunnelListFile)
+			say("Socket connection is removed\n")
+		} else {
+			if bQuiet || jsonOutput() {
+				// if running in a script it is assumed a new master connection is wanted each time
+				os.Remove(ctrlSocket)
+				os.Remove(tunnelListFile)
+			} else
+			{
+				fail(exitAttached, "Server %s already attached %s", *proxyServerAddr, output)
+			}
 		}
 
+	}
+
+	os.Remove(tunnelListFile)
 
-		stdout, err := cmd.StdoutPipe()
+	socksSocket = *socksStart
+	if (!bSocks || builtinSocks()) {
+		socksSocket = -1
+	}
 
+	var err error
+	socksSocket, err = startMaster(socksSocket, *socksEnd)
+	if err != nil {
+		fail(exitSSH, "Attach to %s failed: %v", *proxyServerAddr, err)
+	}
+
+	say("Server %s is now attached\n", *proxyServerAddr)
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	if socksSocket > -1 {
+		say("Socks server on port %d\n", socksSocket)
+		sayQuiet("%d\n", socksSocket)
+		saveTunnel2Config("SOCKS server at %s\n", strconv.Itoa(socksSocket))
+		result.SocksPort = socksSocket
+	}
+	if bSocks && builtinSocks() {
+		pid, port, err := startDaemon("socks")
 		if err != nil {
-			log.Fatal(err)
+			failResult(exitPartial, result, "SOCKS5 server failed: %v", err)
 		}
-
-		err = cmd.Start()
+		say("SOCKS5 server on port %s\n", port)
+		sayQuiet("%s\n", port)
+		saveTunnel2Config("%s\n", TunnelRecord{Kind: "Socks5", Spec: port, Pid: pid}.String())
+		result.SocksPort, _ = strconv.Atoi(port)
+	}
+	if bHTTP {
+		pid, port, err := startDaemon("http-proxy")
 		if err != nil {
-			log.Fatal(err)
+			failResult(exitPartial, result, "HTTP proxy failed: %v", err)
 		}
+		say("HTTP proxy on port %s\n", port)
+		sayQuiet("%s\n", port)
+		saveTunnel2Config("%s\n", TunnelRecord{Kind: "HttpProxy", Spec: port, Pid: pid}.String())
+		result.HTTPPort, _ = strconv.Atoi(port)
+	}
+	done(result)
+}
 
-		go io.Copy(os.Stdout, stdout)
-
-		err = cmd.Wait()
-		if err != nil {
-			if bSocks && socksSocket < *socksEnd {
-				socksSocket++
-				goto retryMaster
-			}
-			log.Fatal(err)
+func detachCommand(args []string) {
+	lockInstance()
+	if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
+		if bQuiet {
+			os.Exit(exitOK)
 		}
+		fail(exitNotAttached, "Server %s already detached", *proxyServerAddr)
+	}
+
+	// the daemons go first, or the agent would reconnect
+	records, _ := readTunnelRecords(tunnelListFile)
+	stopDaemons(records)
+
+	cmd := sshCommand("-O", "stop", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		say("%v: %s", err, output)
+		os.Remove(ctrlSocket)
+		os.Remove(tunnelListFile)
+		say("Socket connection is removed\n")
+	} else {
+		say("%s\n", output)
+	}
 
-		if !bQuiet {
-			fmt.Printf("Server %s is now attached\n", *proxyServerAddr)
+	say("Server %s is now detached\n", *proxyServerAddr)
+	os.Remove(tunnelListFile)
+	done(Result{Server: *proxyServerAddr, Profile: profileName})
+}
+
+func forwardCommand(args []string) {
+	requireAttached()
+	spec, _ := parseTunnelSpec(args[0])
+	if spec.Bind == "" && spec.Socket == "" {
+		spec.Bind = bindAddr
+	}
+	result := Result{LocalPort: spec.Port, Socket: spec.Socket, Remote: spec.Target()}
+
+	if active, ok := forwardedTo(spec.Bind, spec.Target()); ok {
+		say("Forward tunnel %s is already active\n", active)
+		if active.Socket != "" {
+			sayQuiet("%s\n", active.Socket)
+		} else {
+			sayQuiet("%d\n", active.Port)
 		}
-		if socksSocket > -1 {
-			if !bQuiet {
-				fmt.Print("Socks server on port ")
-			}
-			fmt.Printf("%d\n", socksSocket)
-			saveTunnel2Config("SOCKS server at %s\n", strconv.Itoa(socksSocket))
-		}
-		os.Exit(0)
-	} else if command == "detach" {
-		if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
-			if bQuiet {
-				os.Exit(0)
-			}
-			fmt.Printf("Server %s already detached", *proxyServerAddr)
-			os.Exit(1)
+		result.LocalPort, result.Socket = active.Port, active.Socket
+		done(result)
+	}
+	if err := openTunnel("-L", spec.String()); err != nil {
+		failResult(exitSSH, result, "Forward tunnel %s failed: %v", spec, err)
+	}
+	say("Forward tunnel %s active\n", spec)
+	recordTunnel("Forward", spec.String(), 0)
+	done(result)
+}
+
+func autoforwardCommand(args []string) {
+	requireAttached()
+	spec, _ := parseTarget(args[0])
+	spec.Bind = bindAddr
+	result := Result{Remote: spec.Target()}
+
+	if active, ok := forwardedTo(spec.Bind, spec.Target()); ok && active.Socket == "" {
+		say("Forward tunnel %s is already active\n", active)
+		sayQuiet("%d\n", active.Port)
+		result.LocalPort = active.Port
+		done(result)
+	}
+
+	picker := newPortPicker(*portStart, *portEnd, *portStrategy, portsFile)
+	inUse := func(port int) bool { return localPortInUse(spec.Bind, port) }
+	candidates := picker.Candidates(args[0], inUse, maxPortAttempts)
+	if len(candidates) == 0 {
+		failResult(exitNoPort, result, "No free port from %d to %d for %s", *portStart, *portEnd, args[0])
+	}
+	var err error
+	for _, spec.Port = range candidates {
+		if err = openTunnel("-L", spec.String()); err == nil {
+			break
 		}
+	}
+	if err != nil {
+		failResult(exitNoPort, result, "No usable port from %d to %d for %s: %v", *portStart, *portEnd, args[0], err)
+	}
+	picker.Remember(args[0], spec.Port)
+	say("Forward tunnel %s active\n", spec)
+	sayQuiet("%d\n", spec.Port)
+	recordTunnel("Forward", spec.String(), 0)
+	result.LocalPort = spec.Port
+	done(result)
+}
 
-		cmd := exec.Command(*sshbin, "-O", "stop", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr)
+func remoteCommand(args []string) {
+	requireAttached()
+	spec, _ := parseTunnelSpec(args[0])
+	result := Result{LocalPort: spec.HostPort, Socket: spec.HostSocket, Remote: args[0]}
 
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			if !bQuiet {
-				fmt.Println(fmt.Sprint(err) + ": " + string(output))
-				os.Remove(ctrlSocket)
-				os.Remove(tunnelListFile)
-				fmt.Println("Socket connection is removed")
-			}
-		} else {
-			fmt.Println(string(output))
+	if err := openTunnel("-R", args[0]); err != nil {
+		failResult(exitSSH, result, "Remote tunnel %s failed: %v", args[0], err)
+	}
+	say("Remote tunnel %s active\n", args[0])
+	recordTunnel("Remote", args[0], 0)
+	done(result)
+}
+
+func autoremoteCommand(args []string) {
+	requireAttached()
+	local, _ := parseTarget(args[0])
+	result := Result{LocalPort: local.HostPort, Socket: local.HostSocket}
+
+	listening, err := remoteListeningPorts()
+	inUse := func(port int) bool { return listening[port] }
+	if err != nil {
+		// let ssh find out which ports are taken
+		inUse = func(port int) bool { return false }
+	}
+
+	picker := newPortPicker(*portStart, *portEnd, *portStrategy, portsFile)
+	target := "remote:" + args[0]
+	candidates := picker.Candidates(target, inUse, maxPortAttempts)
+	if len(candidates) == 0 {
+		failResult(exitNoPort, result, "No free port on %s from %d to %d", *proxyServerAddr, *portStart, *portEnd)
+	}
+	var port int
+	for _, port = range candidates {
+		if err = openTunnel("-R", fmt.Sprintf("%d:%s", port, local.Target())); err == nil {
+			break
 		}
+	}
+	if err != nil {
+		failResult(exitNoPort, result, "No usable port on %s from %d to %d: %v", *proxyServerAddr, *portStart, *portEnd, err)
+	}
+	picker.Remember(target, port)
+
+	spec := fmt.Sprintf("%d:%s", port, args[0])
+	say("Remote tunnel %s active\n", spec)
+	sayQuiet("%d\n", port)
+	recordTunnel("Remote", spec, 0)
+	result.Remote = spec
+	done(result)
+}
+
+// builtinSocks tells if SOCKS is served by the Client rather than ssh -D,
+// which only works over the ssh transport and has no UDP.
+func builtinSocks() bool {
+	return *socksBuiltin || *transportName != "ssh"
+}
 
-		if !bQuiet {
-			fmt.Printf("Server %s is now detached\n", *proxyServerAddr)
+func socksCommand(args []string) {
+	requireAttached()
+	transport, err := newTransport()
+	if err != nil {
+		daemonReady("", err)
+		fail(exitConfig, "%v", err)
+	}
+
+	l, err := listenRange(args, *socksStart, *socksEnd)
+	if err != nil {
+		daemonReady("", err)
+		fail(exitNoPort, "SOCKS5 server could not listen: %v", err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	say("SOCKS5 server on port %d\n", port)
+	sayQuiet("%d\n", port)
+	daemonReady(strconv.Itoa(port), nil)
+
+	server := &SocksServer{transport, *socksUser, *socksPassword}
+	err = server.Serve(l)
+	fail(exitFailure, "SOCKS5 server: %v", err)
+}
+
+// listenHost is the address the listeners of the Client bind, the IPv4
+// loopback address unless --bind is given, and every address for "*".
+func listenHost() string {
+	switch bindAddr {
+	case "", "localhost":
+		return "127.0.0.1"
+	case "*":
+		return ""
+	}
+	return bindAddr
+}
+
+// listenRange listens on the port given in args, or else on the first free
+// port from first to last.
+func listenRange(args []string, first int, last int) (net.Listener, error) {
+	if len(args) == 1 {
+		port, _ := strconv.Atoi(args[0])
+		return net.Listen("tcp", joinHostPort(listenHost(), port))
+	}
+	var err error
+	for port := first; port <= last; port++ {
+		var l net.Listener
+		if l, err = net.Listen("tcp", joinHostPort(listenHost(), port)); err == nil {
+			return l, nil
 		}
-		os.Remove(tunnelListFile)
-		os.Exit(0)
-	} else if command == "forward" {
-		if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
-			if bQuiet {
-				fmt.Println("-1")
-			} else {
-				fmt.Printf("Server %s is not attached\n", *proxyServerAddr)
-			}
-			os.Exit(1)
+	}
+	return nil, err
+}
+
+func httpProxyCommand(args []string) {
+	requireAttached()
+	transport, err := newTransport()
+	if err != nil {
+		daemonReady("", err)
+		fail(exitConfig, "%v", err)
+	}
+
+	l, err := listenRange(args, *httpStart, *httpEnd)
+	if err != nil {
+		daemonReady("", err)
+		fail(exitNoPort, "HTTP proxy could not listen: %v", err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	say("HTTP proxy on port %d\n", port)
+	sayQuiet("%d\n", port)
+	daemonReady(strconv.Itoa(port), nil)
+
+	err = http.Serve(l, newHTTPProxy(transport))
+	fail(exitFailure, "HTTP proxy: %v", err)
+}
+
+// startTunnelDaemon serves a tunnel of the kind in a daemon running the
+// named command with spec, unless one is already serving it.
+func startTunnelDaemon(kind string, name string, spec string, result Result) {
+	if _, ok := activeDaemon(kind, spec); ok {
+		say("%s tunnel %s is already active\n", kind, spec)
+		done(result)
+	}
+	pid, _, err := startDaemon(name, spec)
+	if err != nil {
+		failResult(exitSSH, result, "%s tunnel %s failed: %v", kind, spec, err)
+	}
+	say("%s tunnel %s active\n", kind, spec)
+	recordTunnel(kind, spec, pid)
+	done(result)
+}
+
+func forwardUDPCommand(args []string) {
+	requireAttached()
+	spec, _ := parseTunnelSpec(args[0])
+	result := Result{LocalPort: spec.Port, Remote: joinHostPort(spec.Host, spec.HostPort)}
+	if !bForeground {
+		startTunnelDaemon("ForwardUdp", "forward-udp", args[0], result)
+	}
+
+	transport, err := newTransport()
+	if err != nil {
+		daemonReady("", err)
+		fail(exitConfig, "%v", err)
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(listenHost()), Port: spec.Port})
+	if err != nil {
+		daemonReady("", err)
+		failResult(exitNoPort, result, "UDP port %d: %v", spec.Port, err)
+	}
+	daemonReady(args[0], nil)
+	say("UDP forward tunnel %s active\n", args[0])
+
+	err = serveForwardUDP(pc, transport, result.Remote, udpIdle())
+	fail(exitFailure, "UDP forward tunnel %s: %v", args[0], err)
+}
+
+func remoteUDPCommand(args []string) {
+	requireAttached()
+	spec, _ := parseTunnelSpec(args[0])
+	result := Result{LocalPort: spec.HostPort, Remote: args[0]}
+	if !bForeground {
+		startTunnelDaemon("RemoteUdp", "remote-udp", args[0], result)
+	}
+
+	stream, err := dialRemoteUDP(spec.Port)
+	if err != nil {
+		daemonReady("", err)
+		failResult(exitSSH, result, "%v", err)
+	}
+	daemonReady(args[0], nil)
+	say("UDP remote tunnel %s active\n", args[0])
+
+	err = serveRemoteUDP(stream, joinHostPort(spec.Host, spec.HostPort), udpIdle())
+	fail(exitSSH, "UDP remote tunnel %s: %v", args[0], err)
+}
+
+func tapCommand(args []string) {
+	requireAttached()
+	device := *tapDevice
+	if len(args) == 1 {
+		device = args[0]
+	}
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	if !bForeground {
+		startTunnelDaemon("Tap", "tap", device, result)
+	}
+
+	transport, err := newTransport()
+	if err != nil {
+		daemonReady("", err)
+		fail(exitConfig, "%v", err)
+	}
+	if err := serveTap(transport, device); err != nil {
+		daemonReady("", err)
+		fail(exitFailure, "tap %s: %v", device, err)
+	}
+}
+
+func udplistenCommand(args []string) {
+	if err := udpListen(args[0]); err != nil {
+		fail(exitFailure, "udplisten %s: %v", args[0], err)
+	}
+}
+
+func udprelayCommand(args []string) {
+	if err := relayUDP(args[0], udpIdle()); err != nil {
+		fail(exitFailure, "udprelay %s: %v", args[0], err)
+	}
+}
+
+func reconnectCommand(args []string) {
+	lockInstance()
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	failed, err := reconnect()
+	if err == errStillAttached {
+		fail(exitAttached, "Server %s is still attached", *proxyServerAddr)
+	} else if err != nil {
+		fail(exitSSH, "Reconnect to %s failed: %v", *proxyServerAddr, err)
+	}
+	if len(failed) > 0 {
+		for _, record := range failed {
+			say("Not restored: %s\n", record)
+			sayQuiet("%s\n", record)
 		}
-		if checkTunnelPresent(tunnelListFile, "Forward", getLastPortFromString(os.Args[len(os.Args)-1])) {
-			if bQuiet {
-				fmt.Printf("%s\n", getLocalTunnelPort(tunnelListFile, "Forward", getLastPortFromString(os.Args[len(os.Args)-1])))
-			} else {
-				fmt.Printf("Forward tunnel %s is already active\n", os.Args[len(os.Args)-1])
-			}
-			os.Exit(0)
+		result.Tunnels = failed
+		failResult(exitPartial, result, "%d tunnels could not be restored", len(failed))
+	}
+	say("Server %s is now reattached\n", *proxyServerAddr)
+	done(result)
+}
+
+func checkCommand(args []string) {
+	requireAttached()
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	latency, err := masterEcho()
+	if err != nil {
+		failResult(exitSSH, result, "Master connection to %s is dead: %v", *proxyServerAddr, err)
+	}
+	result.Latency = milliseconds(latency)
+	say("Master %s: up %.1fms\n", *proxyServerAddr, result.Latency)
+
+	records, _ := readTunnelRecords(tunnelListFile)
+	result.Health = checkTunnels(records)
+	bad := 0
+	for _, health := range result.Health {
+		say("%s\n", health)
+		if health.State != stateUp {
+			sayQuiet("%s\n", health)
+			bad++
 		}
-		cmd := exec.Command(*sshbin, "-4", "-O", "forward", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-L", os.Args[len(os.Args)-1], *proxyServerAddr,
-			"-o", "ExitOnForwardFailure=yes")
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Fatal(err)
+	}
+	if bad > 0 {
+		failResult(exitPartial, result, "%d of %d tunnels are not up", bad, len(records))
+	}
+	done(result)
+}
+
+func agentCommand(args []string) {
+	requireAttached()
+	interval, _ := parseInterval(args)
+	spec := strconv.Itoa(int(interval / time.Second))
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	if !bForeground {
+		startTunnelDaemon("Agent", "agent", spec, result)
+	}
+	daemonReady(spec, nil)
+	runAgent(interval)
+	done(result)
+}
+
+func trustCommand(args []string) {
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	found := false
+	for _, hop := range hopChain() {
+		if len(args) == 1 && args[0] != hop.Host && args[0] != hop.Name {
+			continue
 		}
-		stderr, err := cmd.StderrPipe()
+		found = true
+		known := knownFingerprints(hop)
+		fingerprints, err := trustHost(hop)
 		if err != nil {
-			log.Fatal(err)
+			failResult(exitSSH, result, "%v", err)
 		}
-		err = cmd.Start()
-		if err != nil {
-			log.Fatal(err)
+		if len(known) > 0 && strings.Join(known, " ") != strings.Join(fingerprints, " ") {
+			say("%s: replaced %s\n", hop, strings.Join(known, ", "))
 		}
+		say("%s: trusted %s\n", hop, strings.Join(fingerprints, ", "))
+		sayQuiet("%s %s\n", knownHostName(hop), strings.Join(fingerprints, " "))
+		result.Route = append(result.Route, hop.String())
+	}
+	if !found {
+		fail(exitUsage, "%s is not on the route to %s", args[0], *proxyServerAddr)
+	}
+	done(result)
+}
 
-		go io.Copy(os.Stdout, stdout)
-		go io.Copy(os.Stderr, stderr)
+func applyCommand(args []string) {
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	wanted, err := readManifest(args[0], profileName)
+	if err != nil {
+		fail(exitConfig, "%v", err)
+	}
 
-		err = cmd.Wait()
-		if err != nil {
+	_, err = os.Stat(ctrlSocket)
+	attached := err == nil && masterAlive()
+	var records []TunnelRecord
+	if attached {
+		records, _ = readTunnelRecords(tunnelListFile)
+	}
+	create, remove := planManifest(wanted, records)
+	if !attached {
+		result.Plan = append(result.Plan, PlanStep{"attach", "", *proxyServerAddr})
+	}
+	for _, r := range remove {
+		result.Plan = append(result.Plan, PlanStep{"remove", "", r.String()})
+	}
+	for _, m := range create {
+		result.Plan = append(result.Plan, PlanStep{"create", m.Name, m.String()})
+	}
+	for _, step := range result.Plan {
+		say("%s\n", step)
+		sayQuiet("%s\n", step)
+	}
+	if len(result.Plan) == 0 {
+		say("Tunnels match %s\n", args[0])
+	}
+	if bDryRun {
+		done(result)
+	}
 
-			log.Fatal(err)
+	if !attached {
+		if _, err := runSelf("attach"); err != nil {
+			failResult(exitSSH, result, "%v", err)
 		}
-		if !bQuiet {
-			fmt.Printf("Forward tunnel %s active\n", os.Args[len(os.Args)-1])
+	}
+	failed := 0
+	for _, r := range remove {
+		if err := removeTunnel(r); err != nil {
+			say("%s could not be removed: %v\n", r, err)
+			failed++
+			continue
 		}
-		saveTunnel2Config("Forward %s\n", os.Args[len(os.Args)-1])
-		os.Exit(0)
-	} else if command == "autoforward" {
-		if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
-			if bQuiet {
-				fmt.Println("-1")
-			} else {
-				fmt.Printf("Server %s is not attached\n", *proxyServerAddr)
-			}
-			os.Exit(1)
+		forgetTunnel(r)
+	}
+	for _, m := range create {
+		arg := []string{"--name", m.Name, m.Type}
+		if m.Spec != "" {
+			arg = append(arg, m.Spec)
 		}
-		if checkTunnelPresent(tunnelListFile, "Forward", getLastPortFromString(os.Args[len(os.Args)-1])) {
-			if bQuiet {
-				fmt.Printf("%s\n", getLocalTunnelPort(tunnelListFile, "Forward", getLastPortFromString(os.Args[len(os.Args)-1])))
-			} else {
-				fmt.Printf("Forward tunnel %s is already active\n", os.Args[len(os.Args)-1])
-			}
-			os.Exit(0)
+		if _, err := runSelf(arg...); err != nil {
+			say("%s could not be created: %v\n", m.Name, err)
+			failed++
 		}
-		port := *portStart
+	}
+	if failed > 0 {
+		failResult(exitPartial, result, "%d of %d changes failed", failed, len(result.Plan))
+	}
+	done(result)
+}
 
-	retryForward:
+func envCommand(args []string) {
+	requireAttached()
+	format := "shell"
+	if len(args) == 1 {
+		format = args[0]
+	}
+	if format == "json" {
+		outputFormat = "json"
+	}
+	records, _ := readTunnelRecords(tunnelListFile)
+	result := Result{Server: *proxyServerAddr, Profile: profileName, Env: tunnelEnv(records)}
+	if !jsonOutput() {
+		// the variables are the output, -q or not
+		fmt.Print(formatEnv(result.Env, format))
+	}
+	done(result)
+}
 
-		cmd := exec.Command(*sshbin, "-4", "-O", "forward", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-L",
-			fmt.Sprintf("%d:%s", port, os.Args[len(os.Args)-1]), *proxyServerAddr,
-			"-o", "ExitOnForwardFailure=yes")
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
-		}
-		/*    stderr, err := cmd.StderrPipe()
-		     if err != nil {
-				fmt.Println("2")
-		        log.Fatal(err)
-		     }
-		*/
-		err = cmd.Start()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
-		}
+func runCommandUnderTunnels(args []string) {
+	tunnels, child := splitRunArgs(args)
+	wanted, err := runTunnels(tunnels)
+	if err != nil {
+		fail(exitConfig, "%v", err)
+	}
 
-		go io.Copy(os.Stdout, stdout)
-		//    go io.Copy(os.Stderr, stderr)
+	// a signal during the setup, the attach included, tears it down
+	signals := setupSignals()
 
-		err = cmd.Wait()
-		if err != nil {
-			if port < *portEnd {
-				port++
-				goto retryForward
-			}
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
+	attached := false
+	if !masterAlive() {
+		if _, err := runSelf("attach"); err != nil {
+			if caught(signals) {
+				abortSetup(signals, nil, true, exitSSH, "%v", err)
 			}
-
-			log.Fatal(err)
+			fail(exitSSH, "%v", err)
 		}
-		if bQuiet {
-			fmt.Printf("%d\n", port)
-		} else {
-			fmt.Printf("Forward tunnel %d:%s active\n", port, os.Args[len(os.Args)-1])
-		}
-		saveTunnel2Config("Forward %s:%s\n",strconv.Itoa(port) ,os.Args[len(os.Args)-1])
-
-		os.Exit(0)
-	} else if command == "remote" {
-		if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
-			if bQuiet {
-				fmt.Println("-1")
-			} else {
-				fmt.Printf("Server %s is not attached", *proxyServerAddr)
-			}
-			os.Exit(1)
+		attached = true
+	}
+	before, _ := readTunnelRecords(tunnelListFile)
+	if caught(signals) {
+		abortSetup(signals, before, attached, exitFailure, "Interrupted")
+	}
+	create, _ := planManifest(wanted, before)
+	for _, m := range create {
+		arg := []string{m.Type}
+		if m.Spec != "" {
+			arg = append(arg, m.Spec)
 		}
-
-		cmd := exec.Command(*sshbin, "-O", "forward", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-R", os.Args[len(os.Args)-1], *proxyServerAddr)
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
+		if m.Name != "" {
+			arg = append([]string{"--name", m.Name}, arg...)
 		}
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
+		if _, err := runSelf(arg...); err != nil {
+			abortSetup(signals, before, attached, exitSSH, "%v", err)
 		}
-		err = cmd.Start()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
+		if caught(signals) {
+			abortSetup(signals, before, attached, exitFailure, "Interrupted")
 		}
+	}
+	after, _ := readTunnelRecords(tunnelListFile)
+	added := addedRecords(before, after)
 
-		go io.Copy(os.Stdout, stdout)
-		go io.Copy(os.Stderr, stderr)
-
-		err = cmd.Wait()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
-		}
-		if !bQuiet {
-			fmt.Printf("Remote tunnel %s active\n", os.Args[len(os.Args)-1])
-		}
-		saveTunnel2Config("Remote %s\n", os.Args[len(os.Args)-1])
-		os.Exit(0)
-	} else if command == "autoremote" {
-		if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
-			if bQuiet {
-				fmt.Println("-1")
-			} else {
-				fmt.Printf("Server %s is not attached", *proxyServerAddr)
-			}
-			os.Exit(1)
-		}
-		port := *portStart
+	env := os.Environ()
+	tunnelVars := tunnelEnv(after)
+	for _, name := range envNames(tunnelVars) {
+		env = append(env, name+"="+tunnelVars[name])
+	}
+	code := runChild(child, env)
+	tearDown(added, attached)
+	os.Exit(code)
+}
 
-	retryRemote:
+func gcCommand(args []string) {
+	result := Result{}
+	for _, base := range instanceBases() {
+		result.Removed = append(result.Removed, collectInstance(base)...)
+	}
+	result.Removed = append(result.Removed, collectLocks()...)
+	for _, removed := range result.Removed {
+		say("Removed %s\n", removed)
+		sayQuiet("%s\n", removed)
+	}
+	if len(result.Removed) == 0 {
+		say("Nothing to clean up\n")
+	}
+	done(result)
+}
 
-		cmd := exec.Command(*sshbin, "-4", "-O", "forward", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-R",
-			fmt.Sprintf("%s:%d", os.Args[len(os.Args)-1], port), *proxyServerAddr,
-			"-o", "ExitOnForwardFailure=yes")
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
-		}
-		/*    stderr, err := cmd.StderrPipe()
-		     if err != nil {
-				fmt.Println("2")
-		        log.Fatal(err)
-		     }
-		*/
-		err = cmd.Start()
-		if err != nil {
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-			log.Fatal(err)
+func routeCommand(args []string) {
+	chain := hopChain()
+	result := Result{Server: *proxyServerAddr, Profile: profileName}
+	for _, hop := range chain {
+		sayQuiet("%s\n", hop)
+		result.Route = append(result.Route, hop.String())
+	}
+	say("Route:\n%s\n", hostname)
+	for i, hop := range chain {
+		if i == len(chain)-1 {
+			say(" -> %s (proxy)\n", hop)
+		} else {
+			say(" -> %s (hop %d)\n", hop, i+1)
 		}
+	}
+	_, err := os.Stat(ctrlSocket)
+	result.Attached = boolResult(err == nil)
+	if err == nil {
+		say("Attached\n")
+	} else {
+		say("Not attached\n")
+	}
+	done(result)
+}
 
-		go io.Copy(os.Stdout, stdout)
-		//    go io.Copy(os.Stderr, stderr)
-
-		err = cmd.Wait()
+func profilesCommand(args []string) {
+	var result Result
+	names := append([]string{""}, profileList()...)
+	for _, name := range names {
+		p, _ := resolveProfile(name)
+		pbase := profileBase(p, homeDir, hostname)
+		records, _ := readTunnelRecords(pbase + ".txt")
+		_, err := os.Stat(pbase)
+		result.Profiles = append(result.Profiles, Result{Profile: name, Server: p.Address, User: p.User,
+			Instance: intResult(p.Instance), Attached: boolResult(err == nil), Tunnels: records})
+
+		if name == "" {
+			name = "(default)"
+		}
+		status := "Attached"
 		if err != nil {
-			log.Fatal(err)
-			if port < *portEnd {
-				port++
-				goto retryRemote
-			}
-			if bQuiet {
-				fmt.Println("-1")
-				os.Exit(1)
-			}
-
-			log.Fatal(err)
+			status = "Not attached"
 		}
-		if bQuiet {
-			fmt.Printf("%d\n", port)
-		} else {
-			fmt.Printf("Remote tunnel %s:%d active\n", os.Args[len(os.Args)-1], port)
-		}
-		saveTunnel2Config("Remote %s:%d\n", os.Args[len(os.Args)-1], strconv.Itoa(port))
-		os.Exit(0)
-	} else if command == "config" {
-		fmt.Printf("Configuration:\nInstance: %d\nServer: %s\n", *instance, *proxyServerAddr)
-		if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
-			fmt.Printf("Not attached\n")
-			os.Exit(0)
-		} else {
-			fmt.Printf("Attached to Proxy %s\n", *proxyServerAddr)
+		sayQuiet("%s %s\n", name, status)
+		say("%s: %s@%s instance %d: %s\n", name, p.User, p.Address, p.Instance, status)
+		for _, record := range records {
+			say("  %s\n", record)
 		}
+	}
+	done(result)
+}
+
+func configCommand(args []string) {
+	result := Result{Server: *proxyServerAddr, Profile: profileName, Instance: intResult(*instance), User: userName}
+	// config has no terse form for -q
+	bQuiet = false
+	say("Configuration:\nInstance: %d\nServer: %s\n", *instance, *proxyServerAddr)
+	if profileName != "" {
+		say("Profile: %s\n", profileName)
+	}
+	if _, err := os.Stat(ctrlSocket); os.IsNotExist(err) {
+		say("Not attached\n")
+		result.Attached = boolResult(false)
+		done(result)
+	}
+	if !masterAlive() {
+		say("Master connection to %s is dead, run reconnect\n", *proxyServerAddr)
+		result.Attached = boolResult(false)
+		done(result)
+	}
+	say("Attached to Proxy %s\n", *proxyServerAddr)
+	result.Attached = boolResult(true)
 
-		fmt.Printf("User: %s\n", userName)
+	say("User: %s\n", userName)
 
-		lines, err := readLines(tunnelListFile)
-		if err == nil {
-			if len(lines) > 0 {
-
-				fmt.Printf("Tunnels:\n")
-				for _, item := range lines {
-					fmt.Println(item)
-				}
-			} else {
-				fmt.Println("No active tunnels")
-			}
-		} else {
-			fmt.Println("No active tunnels")
+	records, _ := readTunnelRecords(tunnelListFile)
+	if len(records) > 0 {
+		say("Tunnels:\n")
+		for _, record := range records {
+			say("%s\n", record)
 		}
-		os.Exit(0)
 	} else {
-		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
-		os.Exit(1)
+		say("No active tunnels\n")
 	}
+	result.Tunnels = records
+	done(result)
 }
@@ -0,0 +1,274 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	config "github.com/stvp/go-toml-config"
+)
+
+// ManifestTunnel is one tunnel wanted by a manifest, a [tunnel.<name>]
+// section, or [profile.<name>.tunnel.<name>] for a profile:
+//
+//	[tunnel.web]
+//	type = "autoforward"
+//	spec = "web:80"
+//
+// The type is the command creating the tunnel and spec its argument.
+type ManifestTunnel struct {
+	Name string
+	Type string
+	Spec string `json:",omitempty"`
+}
+
+func (m ManifestTunnel) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", m.Type, m.Spec))
+}
+
+// manifestTypes are the commands a manifest may use.
+var manifestTypes = []string{"forward", "autoforward", "remote", "autoremote", "socks", "http-proxy", "forward-udp", "remote-udp", "tap"}
+
+var manifestSectionRe = regexp.MustCompile(`^\s*\[(profile\.([A-Za-z0-9_-]+)\.)?tunnel\.([A-Za-z0-9_-]+)\]`)
+
+// readManifest returns the tunnels the manifest at path wants for the
+// profile, "" being the top level. As for hops, a profile only gets the
+// tunnels of its own sections.
+func readManifest(path string, profile string) ([]ManifestTunnel, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	set := config.NewConfigSet("manifest", flag.ContinueOnError)
+	type options struct {
+		name    string
+		profile string
+		typ     *string
+		spec    *string
+	}
+	var sections []options
+	seen := map[string]bool{}
+	for _, line := range lines {
+		result := manifestSectionRe.FindStringSubmatch(line)
+		if len(result) != 4 || seen[result[1]+result[3]] {
+			continue
+		}
+		seen[result[1]+result[3]] = true
+		prefix := result[1] + "tunnel." + result[3] + "."
+		sections = append(sections, options{result[3], result[2], set.String(prefix+"type", ""), set.String(prefix+"spec", "")})
+	}
+	if err := set.Parse(path); err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", path, err)
+	}
+
+	var tunnels []ManifestTunnel
+	for _, opt := range sections {
+		if opt.profile != profile {
+			continue
+		}
+		m := ManifestTunnel{opt.name, *opt.typ, *opt.spec}
+		if err := validateManifestTunnel(m); err != nil {
+			return nil, fmt.Errorf("manifest %s: tunnel %s: %v", path, m.Name, err)
+		}
+		tunnels = append(tunnels, m)
+	}
+	return tunnels, nil
+}
+
+func validateManifestTunnel(m ManifestTunnel) error {
+	known := false
+	for _, t := range manifestTypes {
+		known = known || t == m.Type
+	}
+	if !known {
+		return fmt.Errorf("unknown type %q, use one of %s", m.Type, strings.Join(manifestTypes, ", "))
+	}
+	cmd := findCommand(m.Type)
+	var args []string
+	if m.Spec != "" {
+		args = []string{m.Spec}
+	}
+	if len(args) < cmd.MinArgs {
+		return fmt.Errorf("%s needs a spec %s", m.Type, cmd.Args)
+	}
+	if cmd.Validate != nil && len(args) > 0 {
+		return cmd.Validate(args)
+	}
+	return nil
+}
+
+// sameSpec compares two tunnel specs as parsed, so "localhost" and
+// "[::1]" style differences in writing do not count.
+func sameSpec(a string, b string) bool {
+	x, errx := parseTunnelSpec(a)
+	y, erry := parseTunnelSpec(b)
+	if errx != nil || erry != nil {
+		return a == b
+	}
+	return x == y
+}
+
+// sameTarget tells if the recorded tunnel spec leads to the target of an
+// autoforward or autoremote.
+func sameTarget(spec string, target string) bool {
+	x, errx := parseTunnelSpec(spec)
+	y, erry := parseTarget(target)
+	return errx == nil && erry == nil && x.Target() == y.Target()
+}
+
+// satisfies tells if the recorded tunnel is the one the manifest wants.
+func (m ManifestTunnel) satisfies(r TunnelRecord) bool {
+	switch m.Type {
+	case "forward":
+		return r.Kind == "Forward" && sameSpec(r.Spec, m.Spec)
+	case "autoforward":
+		return r.Kind == "Forward" && sameTarget(r.Spec, m.Spec)
+	case "remote":
+		return r.Kind == "Remote" && sameSpec(r.Spec, m.Spec)
+	case "autoremote":
+		return r.Kind == "Remote" && sameTarget(r.Spec, m.Spec)
+	case "socks":
+		return (r.Kind == "SOCKS" || r.Kind == "Socks5") && (m.Spec == "" || r.Spec == m.Spec)
+	case "http-proxy":
+		return r.Kind == "HttpProxy" && (m.Spec == "" || r.Spec == m.Spec)
+	case "forward-udp":
+		return r.Kind == "ForwardUdp" && sameSpec(r.Spec, m.Spec)
+	case "remote-udp":
+		return r.Kind == "RemoteUdp" && sameSpec(r.Spec, m.Spec)
+	case "tap":
+		return r.Kind == "Tap" && (m.Spec == "" || r.Spec == m.Spec)
+	}
+	return false
+}
+
+// PlanStep is one change apply makes, Action being "attach", "create" or
+// "remove".
+type PlanStep struct {
+	Action string
+	Name   string `json:",omitempty"`
+	Tunnel string
+}
+
+func (p PlanStep) String() string {
+	sign := "+"
+	if p.Action == "remove" {
+		sign = "-"
+	}
+	if p.Action == "attach" {
+		return fmt.Sprintf("%s attach %s", sign, p.Tunnel)
+	}
+	if p.Name != "" {
+		return fmt.Sprintf("%s %s (%s)", sign, p.Tunnel, p.Name)
+	}
+	return fmt.Sprintf("%s %s", sign, p.Tunnel)
+}
+
+// planManifest compares the wanted tunnels with the recorded ones. Each
+// record satisfies one wanted tunnel at most. The agent is not a tunnel and
+// is never removed.
+func planManifest(wanted []ManifestTunnel, records []TunnelRecord) ([]ManifestTunnel, []TunnelRecord) {
+	used := make([]bool, len(records))
+	var create []ManifestTunnel
+	for _, m := range wanted {
+		found := false
+		for i, r := range records {
+			if !used[i] && m.satisfies(r) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			create = append(create, m)
+		}
+	}
+	var remove []TunnelRecord
+	for i, r := range records {
+		if !used[i] && r.Kind != "Agent" {
+			remove = append(remove, r)
+		}
+	}
+	return create, remove
+}
+
+// runSelf runs a command of the Client again with the same config and
+// profile, returning its terse output.
+func runSelf(arg ...string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	args := append([]string{"-q"}, selfArgs()...)
+	output, err := exec.Command(self, append(args, arg...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %s", strings.Join(arg, " "), err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// removeTunnel takes a recorded tunnel down, cancelling the forward in the
+// master connection or stopping the daemon serving it.
+func removeTunnel(r TunnelRecord) error {
+	var direction string
+	switch {
+	case r.Pid > 0:
+		if isDaemon(r.Pid, r) {
+			return syscall.Kill(r.Pid, syscall.SIGTERM)
+		}
+		return nil
+	case r.Kind == "Forward":
+		direction = "-L"
+	case r.Kind == "Remote":
+		direction = "-R"
+	case r.Kind == "SOCKS":
+		direction = "-D"
+	default:
+		return fmt.Errorf("%s tunnels cannot be removed", r.Kind)
+	}
+	output, err := sshCommand("-O", "cancel", "-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), direction, r.Spec, *proxyServerAddr).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// forgetTunnel drops a removed tunnel from the tunnel list.
+func forgetTunnel(r TunnelRecord) error {
+	records, err := readTunnelRecords(tunnelListFile)
+	if err != nil {
+		return err
+	}
+	var kept []TunnelRecord
+	for _, record := range records {
+		if record != r {
+			kept = append(kept, record)
+		}
+	}
+	return writeTunnelRecords(tunnelListFile, kept)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanManifest(t *testing.T) {
+	web := ManifestTunnel{Name: "web", Type: "autoforward", Spec: "web:80"}
+	db := ManifestTunnel{Name: "db", Type: "forward", Spec: "5432:db:5432"}
+	socks := ManifestTunnel{Type: "socks"}
+	tests := []struct {
+		name    string
+		wanted  []ManifestTunnel
+		records []TunnelRecord
+		create  []ManifestTunnel
+		remove  []TunnelRecord
+	}{
+		{"nothing", nil, nil, nil, nil},
+		{"all new", []ManifestTunnel{web, db}, nil, []ManifestTunnel{web, db}, nil},
+		{"all there",
+			[]ManifestTunnel{web, db, socks},
+			[]TunnelRecord{{Kind: "Forward", Spec: "8080:web:80"}, {Kind: "Forward", Spec: "5432:db:5432"}, {Kind: "Socks5", Spec: "1080", Pid: 42}},
+			nil, nil},
+		{"one missing, one unwanted",
+			[]ManifestTunnel{web, db},
+			[]TunnelRecord{{Kind: "Forward", Spec: "5432:db:5432"}, {Kind: "Remote", Spec: "2222:localhost:22"}},
+			[]ManifestTunnel{web},
+			[]TunnelRecord{{Kind: "Remote", Spec: "2222:localhost:22"}}},
+		{"same spec written apart",
+			[]ManifestTunnel{{Type: "forward", Spec: "08080:web:080"}},
+			[]TunnelRecord{{Kind: "Forward", Spec: "8080:web:80"}},
+			nil, nil},
+		{"one record for one tunnel",
+			[]ManifestTunnel{web, {Name: "web2", Type: "autoforward", Spec: "web:80"}},
+			[]TunnelRecord{{Kind: "Forward", Spec: "8080:web:80"}},
+			[]ManifestTunnel{{Name: "web2", Type: "autoforward", Spec: "web:80"}},
+			nil},
+		{"kind must match",
+			[]ManifestTunnel{{Type: "remote", Spec: "5432:db:5432"}},
+			[]TunnelRecord{{Kind: "Forward", Spec: "5432:db:5432"}},
+			[]ManifestTunnel{{Type: "remote", Spec: "5432:db:5432"}},
+			[]TunnelRecord{{Kind: "Forward", Spec: "5432:db:5432"}}},
+		{"agent kept",
+			nil,
+			[]TunnelRecord{{Kind: "Agent", Spec: "30", Pid: 7}, {Kind: "HttpProxy", Spec: "3128", Pid: 8}},
+			nil,
+			[]TunnelRecord{{Kind: "HttpProxy", Spec: "3128", Pid: 8}}},
+	}
+	for _, test := range tests {
+		create, remove := planManifest(test.wanted, test.records)
+		if !reflect.DeepEqual(create, test.create) {
+			t.Errorf("%s: create %v, want %v", test.name, create, test.create)
+		}
+		if !reflect.DeepEqual(remove, test.remove) {
+			t.Errorf("%s: remove %v, want %v", test.name, remove, test.remove)
+		}
+	}
+}
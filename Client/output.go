@@ -0,0 +1,141 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Exit codes of the Client. Each class of failure has its own code so that
+// scripts can act on it without parsing messages.
+const (
+	exitOK          = 0
+	exitFailure     = 1 // anything not covered below
+	exitUsage       = 2 // unknown command, bad flags or arguments
+	exitConfig      = 3 // unreadable or invalid config file or profile
+	exitNotAttached = 4 // the command needs an attached proxy
+	exitAttached    = 5 // the proxy is already attached
+	exitSSH         = 6 // ssh failed to set up the connection or tunnel
+	exitNoPort      = 7 // no free port in the configured range
+	exitPartial     = 8 // some of the tunnels could not be set up
+	exitBusy        = 9 // another command is setting up the same instance
+)
+
+// Result is the outcome of a command. With --output json it is printed as a
+// single JSON object, in the same form as the replies of the Server.
+type Result struct {
+	Status    string
+	Command   string
+	Code      int               `json:",omitempty"`
+	Reason    string            `json:",omitempty"`
+	Server    string            `json:",omitempty"`
+	Profile   string            `json:",omitempty"`
+	Instance  *int              `json:",omitempty"`
+	User      string            `json:",omitempty"`
+	Attached  *bool             `json:",omitempty"`
+	LocalPort int               `json:",omitempty"`
+	Socket    string            `json:",omitempty"`
+	Remote    string            `json:",omitempty"`
+	SocksPort int               `json:",omitempty"`
+	HTTPPort  int               `json:",omitempty"`
+	Route     []string          `json:",omitempty"`
+	Tunnels   []TunnelRecord    `json:",omitempty"`
+	Latency   float64           `json:",omitempty"`
+	Health    []TunnelHealth    `json:",omitempty"`
+	Removed   []string          `json:",omitempty"`
+	Plan      []PlanStep        `json:",omitempty"`
+	Env       map[string]string `json:",omitempty"`
+	Profiles  []Result          `json:",omitempty"`
+	Problems  []string          `json:",omitempty"`
+}
+
+var outputFormat string
+
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// say prints progress and human readable results, which are left out with
+// -q and --output json.
+func say(format string, a ...interface{}) {
+	if !bQuiet && !jsonOutput() {
+		fmt.Printf(format, a...)
+	}
+}
+
+// sayQuiet prints the terse output of -q meant for scripts.
+func sayQuiet(format string, a ...interface{}) {
+	if bQuiet && !jsonOutput() {
+		fmt.Printf(format, a...)
+	}
+}
+
+func printResult(r Result) {
+	r.Command = command
+	b, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+}
+
+// done reports the successful result of the command and exits.
+func done(r Result) {
+	if jsonOutput() {
+		r.Status = "OK"
+		printResult(r)
+	}
+	os.Exit(exitOK)
+}
+
+// fail reports a failure of the given class and exits with its code.
+func fail(code int, format string, a ...interface{}) {
+	failResult(code, Result{}, format, a...)
+}
+
+func failResult(code int, r Result, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if jsonOutput() {
+		r.Status = "FAIL"
+		r.Code = code
+		r.Reason = msg
+		printResult(r)
+	} else if bQuiet {
+		fmt.Println("-1")
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	os.Exit(code)
+}
+
+func boolResult(b bool) *bool {
+	return &b
+}
+
+func intResult(i int) *int {
+	return &i
+}
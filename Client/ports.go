@@ -0,0 +1,199 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxPortAttempts limits how many probed ports are handed to ssh before
+// giving up, a port that is free when probed is rarely taken when used.
+const maxPortAttempts = 10
+
+// maxRecentPorts is how many targets the recent port file remembers.
+const maxRecentPorts = 64
+
+// PortPicker chooses the ports tried by autoforward and autoremote. Ports are
+// probed before ssh is asked to use them, and the port last used for a
+// target is tried first so that it keeps its port between attaches.
+type PortPicker struct {
+	First    int
+	Last     int
+	Strategy string
+	File     string
+	recent   []recentPort
+}
+
+type recentPort struct {
+	Target string
+	Port   int
+}
+
+func newPortPicker(first int, last int, strategy string, file string) *PortPicker {
+	p := &PortPicker{First: first, Last: last, Strategy: strategy, File: file}
+	lines, _ := readLines(file)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if port, err := strconv.Atoi(fields[1]); err == nil {
+			p.recent = append(p.recent, recentPort{fields[0], port})
+		}
+	}
+	return p
+}
+
+// Candidates returns up to max ports in the range that are not in use, the
+// port recently used for target first. Ports recently used for other targets
+// are only returned when nothing else is free.
+func (p *PortPicker) Candidates(target string, inUse func(int) bool, max int) []int {
+	var ports, later []int
+	taken := map[int]bool{}
+	for _, r := range p.recent {
+		if r.Target == target {
+			if r.Port >= p.First && r.Port <= p.Last && !inUse(r.Port) {
+				ports = append(ports, r.Port)
+			}
+		}
+		taken[r.Port] = true
+	}
+
+	if p.Last < p.First {
+		return ports
+	}
+	order := make([]int, 0, p.Last-p.First+1)
+	for port := p.First; port <= p.Last; port++ {
+		order = append(order, port)
+	}
+	if p.Strategy == "random" {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		r.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+
+	for _, port := range order {
+		if len(ports) >= max {
+			return ports
+		}
+		if taken[port] {
+			later = append(later, port)
+			continue
+		}
+		if !inUse(port) {
+			ports = append(ports, port)
+		}
+	}
+	for _, port := range later {
+		if len(ports) >= max {
+			break
+		}
+		if !inUse(port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// Remember records port as used for target.
+func (p *PortPicker) Remember(target string, port int) error {
+	recent := []recentPort{{target, port}}
+	for _, r := range p.recent {
+		if r.Target != target && r.Port != port && len(recent) < maxRecentPorts {
+			recent = append(recent, r)
+		}
+	}
+	p.recent = recent
+
+	var b bytes.Buffer
+	for _, r := range recent {
+		fmt.Fprintf(&b, "%s %d\n", r.Target, r.Port)
+	}
+	return ioutil.WriteFile(p.File, b.Bytes(), 0600)
+}
+
+// localPortInUse tells if the port is taken on the address ssh binds the
+// forward tunnel to. Without an address ssh listens on both loopback
+// addresses, the one of a family the host lacks is skipped.
+func localPortInUse(bind string, port int) bool {
+	hosts := []string{bind}
+	switch bind {
+	case "", "localhost":
+		hosts = []string{"127.0.0.1", "::1"}
+	case "*":
+		hosts = []string{""}
+	}
+	for _, host := range hosts {
+		l, err := net.Listen("tcp", joinHostPort(host, port))
+		if err != nil {
+			if errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EAFNOSUPPORT) {
+				continue
+			}
+			return true
+		}
+		l.Close()
+	}
+	return false
+}
+
+// remoteListeningPorts asks the proxy which TCP ports are listening there,
+// read from /proc/net/tcp and /proc/net/tcp6 through the master connection.
+func remoteListeningPorts() (map[int]bool, error) {
+	output, err := sshCommand("-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr,
+		"cat /proc/net/tcp /proc/net/tcp6 2>/dev/null").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseProcNetTCP(output), nil
+}
+
+func parseProcNetTCP(table []byte) map[int]bool {
+	ports := map[int]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(table))
+	for scanner.Scan() {
+		// sl local_address rem_address st ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != "0A" {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		if port, err := strconv.ParseUint(fields[1][i+1:], 16, 16); err == nil {
+			ports[int(port)] = true
+		}
+	}
+	return ports
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCandidates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ports")
+	p := newPortPicker(10000, 10004, "sequential", file)
+	if err := p.Remember("web:80", 10003); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Remember("db:5432", 10001); err != nil {
+		t.Fatal(err)
+	}
+	p = newPortPicker(10000, 10004, "sequential", file)
+
+	inUse := func(port int) bool { return port == 10000 }
+	tests := []struct {
+		target string
+		max    int
+		want   []int
+	}{
+		{"web:80", 3, []int{10003, 10002, 10004}},
+		{"db:5432", 2, []int{10001, 10002}},
+		{"other:1", 5, []int{10002, 10004, 10001, 10003}},
+	}
+	for _, test := range tests {
+		if got := p.Candidates(test.target, inUse, test.max); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Candidates(%s, %d) = %v, want %v", test.target, test.max, got, test.want)
+		}
+	}
+}
+
+func TestCandidatesReversedRange(t *testing.T) {
+	p := newPortPicker(10005, 10000, "random", filepath.Join(t.TempDir(), "ports"))
+	if got := p.Candidates("web:80", func(int) bool { return false }, 5); len(got) != 0 {
+		t.Errorf("Candidates of a reversed range = %v", got)
+	}
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	table := []byte(`  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1 1 0000000000000000 100 0 0 10 0
+   1: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F91 0100007F:C350 01 00000000:00000000 00:00000000 00000000  1000        0 3 1 0000000000000000 20 4 30 10 -1
+   0: 00000000000000000000000001000000:2710 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000 0 4
+garbage
+`)
+	want := map[int]bool{8080: true, 22: true, 10000: true}
+	if got := parseProcNetTCP(table); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProcNetTCP = %v, want %v", got, want)
+	}
+}
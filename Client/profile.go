@@ -0,0 +1,185 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	config "github.com/stvp/go-toml-config"
+)
+
+// Profile is a named proxy setup from a [profile.<name>] section of the
+// config file. Options not given in the section are taken from the top level.
+type Profile struct {
+	Name     string
+	Address  string
+	User     string
+	SSHPort  int
+	Identity string
+	Auth     string
+	Instance int
+	// Fingerprint pins the host key of the proxy
+	Fingerprint string
+}
+
+type profileOptions struct {
+	address     *string
+	user        *string
+	sshport     *int
+	identity    *string
+	auth        *string
+	fingerprint *string
+	instance    *int
+	socksStart  *int
+	socksEnd    *int
+	socksActive *bool
+}
+
+var profileName string
+var profileOptionMap = map[string]*profileOptions{}
+
+var profileSectionRe = regexp.MustCompile(`^\s*\[profile\.([A-Za-z0-9_-]+)\]`)
+
+// declareProfiles scans the config file for [profile.<name>] sections and
+// declares their options before the file is parsed.
+func declareProfiles(path string) {
+	lines, err := readLines(path)
+	if err != nil {
+		return
+	}
+	for _, line := range lines {
+		result := profileSectionRe.FindStringSubmatch(line)
+		if len(result) != 2 || profileOptionMap[result[1]] != nil {
+			continue
+		}
+		prefix := "profile." + result[1] + "."
+		profileOptionMap[result[1]] = &profileOptions{
+			address:     config.String(prefix+"address", ""),
+			user:        config.String(prefix+"user", ""),
+			sshport:     config.Int(prefix+"sshport", -1),
+			identity:    config.String(prefix+"identity", ""),
+			auth:        config.String(prefix+"auth", ""),
+			fingerprint: config.String(prefix+"fingerprint", ""),
+			instance:    config.Int(prefix+"instance", -1),
+			socksStart:  config.Int(prefix+"socksStart", -1),
+			socksEnd:    config.Int(prefix+"socksEnd", -1),
+			socksActive: config.Bool(prefix+"socksActive", false),
+		}
+	}
+}
+
+func profileList() []string {
+	var names []string
+	for name := range profileOptionMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// topLevel is the setup of the top level options, kept before selectProfile
+// overwrites them with the ones of the selected profile.
+var topLevel *Profile
+
+func topLevelProfile() Profile {
+	if topLevel == nil {
+		topLevel = &Profile{"", *proxyServerAddr, *proxyUser, *proxySSHPort, *proxyIdentity, *proxyAuth, *instance, *proxyFingerprint}
+	}
+	return *topLevel
+}
+
+// resolveProfile returns the named profile, or the top level setup for "".
+func resolveProfile(name string) (Profile, error) {
+	p := topLevelProfile()
+	p.Name = name
+	if name == "" {
+		return p, nil
+	}
+	opt, ok := profileOptionMap[name]
+	if !ok {
+		return p, fmt.Errorf("unknown profile %s", name)
+	}
+	if *opt.address != "" {
+		p.Address = *opt.address
+	}
+	if *opt.user != "" {
+		p.User = *opt.user
+	}
+	if *opt.sshport > -1 {
+		p.SSHPort = *opt.sshport
+	}
+	if *opt.identity != "" {
+		p.Identity = *opt.identity
+	}
+	if *opt.auth != "" {
+		p.Auth = *opt.auth
+	}
+	if *opt.instance > -1 {
+		p.Instance = *opt.instance
+	}
+	if *opt.fingerprint != "" {
+		p.Fingerprint = *opt.fingerprint
+	}
+	return p, nil
+}
+
+// selectProfile makes the named profile the one used by every command.
+func selectProfile(name string) error {
+	p, err := resolveProfile(name)
+	if err != nil {
+		return err
+	}
+	profileName = name
+	*proxyServerAddr = p.Address
+	*proxyUser = p.User
+	*proxySSHPort = p.SSHPort
+	*proxyIdentity = p.Identity
+	*proxyAuth = p.Auth
+	*proxyFingerprint = p.Fingerprint
+	*instance = p.Instance
+	if opt := profileOptionMap[name]; opt != nil {
+		if *opt.socksStart > -1 {
+			*socksStart = *opt.socksStart
+		}
+		if *opt.socksEnd > -1 {
+			*socksEnd = *opt.socksEnd
+		}
+		if *opt.socksActive {
+			*socksActive = true
+		}
+	}
+	return nil
+}
+
+// profileBase returns the path that the control socket, tunnel list and ssh
+// config file of a profile are named from. Profiles get their own files even
+// when they share proxy and instance.
+func profileBase(p Profile, home string, hostname string) string {
+	if p.Name == "" {
+		return fmt.Sprintf("%s/.ssh/%s.%s.%d", home, p.Address, hostname, p.Instance)
+	}
+	return fmt.Sprintf("%s/.ssh/%s.%s.%s.%d", home, p.Address, hostname, p.Name, p.Instance)
+}
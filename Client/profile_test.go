@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestResolveProfileAfterSelect(t *testing.T) {
+	topLevel = nil
+	*proxyServerAddr, *proxyUser, *proxySSHPort, *instance = "proxy.example", "proxy", 22, 0
+	address, user, sshport, inst := "other.example", "", 2222, 3
+	empty, none, no := "", -1, false
+	profileOptionMap = map[string]*profileOptions{
+		"x": {&address, &user, &sshport, &empty, &empty, &empty, &inst, &none, &none, &no},
+		"y": {&empty, &empty, &none, &empty, &empty, &empty, &none, &none, &none, &no},
+	}
+	defer func() { profileOptionMap = map[string]*profileOptions{} }()
+
+	if err := selectProfile("x"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		address string
+		port    int
+		inst    int
+	}{
+		{"", "proxy.example", 22, 0},
+		{"x", "other.example", 2222, 3},
+		{"y", "proxy.example", 22, 0},
+	}
+	for _, test := range tests {
+		p, err := resolveProfile(test.name)
+		if err != nil || p.Name != test.name || p.Address != test.address || p.SSHPort != test.port || p.Instance != test.inst {
+			t.Errorf("resolveProfile(%q) = %+v, %v", test.name, p, err)
+		}
+	}
+	if _, err := resolveProfile("z"); err == nil {
+		t.Error("unknown profile resolved")
+	}
+}
+
+func TestProfileBase(t *testing.T) {
+	tests := []struct {
+		p    Profile
+		want string
+	}{
+		{Profile{Address: "proxy", Instance: 0}, "/home/u/.ssh/proxy.host.0"},
+		{Profile{Name: "work", Address: "proxy", Instance: 2}, "/home/u/.ssh/proxy.host.work.2"},
+	}
+	for _, test := range tests {
+		if got := profileBase(test.p, "/home/u", "host"); got != test.want {
+			t.Errorf("profileBase(%+v) = %s, want %s", test.p, got, test.want)
+		}
+	}
+}
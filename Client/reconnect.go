@@ -0,0 +1,207 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// TunnelRecord is one line of the tunnel list file, e.g. "Forward 8080:host:80"
+// or "SOCKS server at 1080". Tunnels served by a daemon of the Client also
+// record its pid, e.g. "Socks5 1080 pid=4711", and tunnels given a name with
+// --name or in a manifest end with it, e.g. "Forward 8080:web:80 name=web".
+type TunnelRecord struct {
+	Kind string
+	Spec string
+	Pid  int    `json:",omitempty"`
+	Name string `json:",omitempty"`
+}
+
+func (t TunnelRecord) String() string {
+	s := fmt.Sprintf("%s %s", t.Kind, t.Spec)
+	if t.Kind == "SOCKS" {
+		s = fmt.Sprintf("SOCKS server at %s", t.Spec)
+	}
+	if t.Pid > 0 {
+		s += fmt.Sprintf(" pid=%d", t.Pid)
+	}
+	if t.Name != "" {
+		s += " name=" + t.Name
+	}
+	return s
+}
+
+func readTunnelRecords(path string) ([]TunnelRecord, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []TunnelRecord
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "SOCKS server at ") {
+			line = "SOCKS " + strings.TrimPrefix(line, "SOCKS server at ")
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		record := TunnelRecord{Kind: fields[0], Spec: fields[1]}
+		for _, field := range fields[2:] {
+			if strings.HasPrefix(field, "pid=") {
+				record.Pid, _ = strconv.Atoi(strings.TrimPrefix(field, "pid="))
+			} else if strings.HasPrefix(field, "name=") {
+				record.Name = strings.TrimPrefix(field, "name=")
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// writeTunnelRecords replaces the tunnel list file with records.
+func writeTunnelRecords(path string, records []TunnelRecord) error {
+	var b strings.Builder
+	for _, record := range records {
+		b.WriteString(record.String() + "\n")
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0600)
+}
+
+var errStillAttached = errors.New("the master connection is still alive")
+
+// reconnect re-attaches a dead master connection and replays every tunnel
+// recorded in the tunnel list file with the same ports. It returns the
+// tunnels that could not be restored. The list is kept until the new master
+// connection is up, so that a failed reconnect can be tried again.
+func reconnect() ([]TunnelRecord, error) {
+	records, err := readTunnelRecords(tunnelListFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if masterAlive() {
+		return nil, errStillAttached
+	}
+	os.Remove(ctrlSocket)
+
+	recorded := -1
+	var socksName string
+	for _, record := range records {
+		if record.Kind == "SOCKS" {
+			socksName = record.Name
+			recorded, err = strconv.Atoi(record.Spec)
+			if err != nil {
+				return nil, fmt.Errorf("bad SOCKS record: %s", record.Spec)
+			}
+		}
+	}
+
+	var failed []TunnelRecord
+
+	var socksPort int
+	if recorded > -1 {
+		socksPort, err = startMaster(recorded, recorded)
+	} else if bSocks && !builtinSocks() {
+		socksPort, err = startMaster(*socksStart, *socksEnd)
+	} else {
+		socksPort, err = startMaster(-1, -1)
+	}
+	if err != nil && recorded > -1 {
+		// the SOCKS port has been taken while detached
+		failed = append(failed, TunnelRecord{Kind: "SOCKS", Spec: strconv.Itoa(recorded)})
+		if bSocks && !builtinSocks() {
+			socksPort, err = startMaster(*socksStart, *socksEnd)
+		} else {
+			socksPort, err = startMaster(-1, -1)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tunnelListFile)
+	if socksPort > -1 {
+		saveTunnel2Config("%s\n", TunnelRecord{Kind: "SOCKS", Spec: strconv.Itoa(socksPort), Name: socksName}.String())
+	}
+
+	served := map[string]bool{}
+	for _, record := range records {
+		if name, ok := daemonCommands[record.Kind]; ok {
+			served[record.Kind] = true
+			// a daemon that survived dials through the new master connection
+			if !isDaemon(record.Pid, record) {
+				pid, _, err := startDaemon(name, record.Spec)
+				if err != nil {
+					say("%s could not be restored: %v\n", record, err)
+					failed = append(failed, record)
+					continue
+				}
+				record.Pid = pid
+			}
+			say("%s restored\n", record)
+			saveTunnel2Config("%s\n", record.String())
+			continue
+		}
+
+		var direction string
+		switch record.Kind {
+		case "Forward":
+			direction = "-L"
+		case "Remote":
+			direction = "-R"
+		default:
+			continue
+		}
+		if err := openTunnel(direction, record.Spec); err != nil {
+			say("%s could not be restored: %v\n", record, err)
+			failed = append(failed, record)
+			continue
+		}
+		say("%s restored\n", record)
+		saveTunnel2Config("%s\n", record.String())
+	}
+
+	if bSocks && builtinSocks() && !served["Socks5"] {
+		pid, port, err := startDaemon("socks")
+		if err != nil {
+			return failed, err
+		}
+		saveTunnel2Config("%s\n", TunnelRecord{Kind: "Socks5", Spec: port, Pid: pid}.String())
+	}
+	if bHTTP && !served["HttpProxy"] {
+		pid, port, err := startDaemon("http-proxy")
+		if err != nil {
+			return failed, err
+		}
+		saveTunnel2Config("%s\n", TunnelRecord{Kind: "HttpProxy", Spec: port, Pid: pid}.String())
+	}
+	return failed, nil
+}
@@ -0,0 +1,194 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// parseRunTunnel parses a tunnel argument of run, "[name=]type[:spec]", e.g.
+// "web=autoforward:web:80" or "socks".
+func parseRunTunnel(s string) (ManifestTunnel, error) {
+	var m ManifestTunnel
+	if i := strings.Index(s, "="); i >= 0 && !strings.Contains(s[:i], ":") {
+		m.Name, s = s[:i], s[i+1:]
+		if !tunnelNameRe.MatchString(m.Name) {
+			return m, fmt.Errorf("bad tunnel name %q", m.Name)
+		}
+	}
+	m.Type = s
+	if i := strings.Index(s, ":"); i >= 0 {
+		m.Type, m.Spec = s[:i], s[i+1:]
+	}
+	return m, validateManifestTunnel(m)
+}
+
+// splitRunArgs splits the arguments of run into the tunnels and the command
+// given after "--".
+func splitRunArgs(args []string) ([]string, []string) {
+	return args[:len(args)-len(dashArgs)], dashArgs
+}
+
+func validateRun(args []string) error {
+	tunnels, child := splitRunArgs(args)
+	if len(child) == 0 {
+		return fmt.Errorf("no command given after --")
+	}
+	for _, t := range tunnels {
+		if strings.HasPrefix(t, "@") {
+			continue
+		}
+		if _, err := parseRunTunnel(t); err != nil {
+			return fmt.Errorf("%s: %v", t, err)
+		}
+	}
+	return nil
+}
+
+// runTunnels lists the tunnels wanted by the arguments of run, "@file"
+// taking those of a manifest.
+func runTunnels(args []string) ([]ManifestTunnel, error) {
+	var wanted []ManifestTunnel
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			tunnels, err := readManifest(arg[1:], profileName)
+			if err != nil {
+				return nil, err
+			}
+			wanted = append(wanted, tunnels...)
+			continue
+		}
+		m, _ := parseRunTunnel(arg)
+		wanted = append(wanted, m)
+	}
+	return wanted, nil
+}
+
+// runChild runs the command with the environment and the terminal of the
+// Client and returns its exit code, 128 plus the signal if it was killed as
+// a shell would. Signals to the Client are passed on to the child, so that
+// the tunnels are taken down only when it is done.
+func runChild(child []string, env []string) int {
+	cmd := exec.Command(child[0], child[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", child[0], err)
+		return 127
+	}
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	err := cmd.Wait()
+	if err == nil {
+		return exitOK
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exit.ExitCode()
+	}
+	return exitFailure
+}
+
+// addedRecords returns the records of after not in before.
+func addedRecords(before []TunnelRecord, after []TunnelRecord) []TunnelRecord {
+	var added []TunnelRecord
+	for _, r := range after {
+		found := false
+		for _, b := range before {
+			found = found || b == r
+		}
+		if !found {
+			added = append(added, r)
+		}
+	}
+	return added
+}
+
+// setupSignals catches the signals that stop run while it sets up its
+// tunnels, so that they are torn down rather than left behind.
+func setupSignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	return signals
+}
+
+// abortSetup tears down what run set up so far and exits, as killed by the
+// signal if one was caught.
+func abortSetup(signals chan os.Signal, before []TunnelRecord, attached bool, code int, format string, a ...interface{}) {
+	after, _ := readTunnelRecords(tunnelListFile)
+	tearDown(addedRecords(before, after), attached)
+	select {
+	case sig := <-signals:
+		fail(128+int(sig.(syscall.Signal)), "Interrupted by %v", sig)
+	default:
+	}
+	fail(code, format, a...)
+}
+
+// caught tells whether a signal was caught during the setup, leaving it for
+// abortSetup.
+func caught(signals chan os.Signal) bool {
+	select {
+	case sig := <-signals:
+		signals <- sig
+		return true
+	default:
+		return false
+	}
+}
+
+// tearDown takes down the tunnels run set up, last first, and detaches if
+// run attached.
+func tearDown(added []TunnelRecord, attached bool) {
+	for i := len(added) - 1; i >= 0; i-- {
+		if err := removeTunnel(added[i]); err != nil {
+			say("%s could not be removed: %v\n", added[i], err)
+			continue
+		}
+		forgetTunnel(added[i])
+	}
+	if attached {
+		if _, err := runSelf("detach"); err != nil {
+			say("%v\n", err)
+		}
+	}
+}
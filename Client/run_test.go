@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestParseRunTunnel(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want ManifestTunnel
+		ok   bool
+	}{
+		{"socks", ManifestTunnel{Type: "socks"}, true},
+		{"socks:1080", ManifestTunnel{Type: "socks", Spec: "1080"}, true},
+		{"web=autoforward:web:80", ManifestTunnel{Name: "web", Type: "autoforward", Spec: "web:80"}, true},
+		{"db-1=forward:5432:db:5432", ManifestTunnel{Name: "db-1", Type: "forward", Spec: "5432:db:5432"}, true},
+		{"forward:[::1]:8080:web:80", ManifestTunnel{Type: "forward", Spec: "[::1]:8080:web:80"}, true},
+		{"tap", ManifestTunnel{Type: "tap"}, true},
+		{"bad name=socks", ManifestTunnel{}, false},
+		{"=socks", ManifestTunnel{}, false},
+		{"teleport", ManifestTunnel{}, false},
+		{"forward", ManifestTunnel{}, false},
+		{"forward:8080", ManifestTunnel{}, false},
+		{"autoremote:8080:web", ManifestTunnel{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseRunTunnel(test.arg)
+		if (err == nil) != test.ok {
+			t.Errorf("parseRunTunnel(%q) error = %v", test.arg, err)
+			continue
+		}
+		if test.ok && got != test.want {
+			t.Errorf("parseRunTunnel(%q) = %+v, want %+v", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestCaught(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	if caught(signals) {
+		t.Fatal("caught without a signal")
+	}
+	signals <- syscall.SIGINT
+	for i := 0; i < 2; i++ {
+		if !caught(signals) {
+			t.Fatalf("check %d: signal not caught", i)
+		}
+	}
+	if sig := <-signals; sig != syscall.SIGINT {
+		t.Errorf("signal left is %v, want SIGINT", sig)
+	}
+}
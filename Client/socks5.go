@@ -0,0 +1,484 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 as in RFC 1928, with username/password authentication as in
+// RFC 1929.
+const (
+	socksVersion     = 5
+	socksAuthNone    = 0
+	socksAuthPass    = 2
+	socksNoMethod    = 0xff
+	socksConnect     = 1
+	socksAssociate   = 3
+	socksAtypIPv4    = 1
+	socksAtypDomain  = 3
+	socksAtypIPv6    = 4
+	socksOK          = 0
+	socksFailure     = 1
+	socksRefused     = 5
+	socksBadCommand  = 7
+	socksBadAddrType = 8
+)
+
+// SocksServer is a SOCKS5 server dialing through the tunnel transport. With
+// User set the clients must authenticate with User and Password.
+type SocksServer struct {
+	Transport Transport
+	User      string
+	Password  string
+}
+
+func (s *SocksServer) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *SocksServer) handle(c net.Conn) {
+	defer c.Close()
+	if err := s.negotiate(c); err != nil {
+		log.Printf("socks %s: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return
+	}
+	host, port, err := readSocksAddr(c)
+	if req[0] != socksVersion || err != nil {
+		writeSocksReply(c, socksBadAddrType, nil)
+		return
+	}
+	addr := joinHostPort(host, port)
+
+	switch req[1] {
+	case socksConnect:
+		conn, err := s.Transport.Dial("tcp", addr)
+		if err != nil {
+			log.Printf("socks connect %s: %v", addr, err)
+			writeSocksReply(c, socksRefused, nil)
+			return
+		}
+		defer conn.Close()
+		writeSocksReply(c, socksOK, nil)
+		relay(c, conn)
+	case socksAssociate:
+		s.associate(c)
+	default:
+		writeSocksReply(c, socksBadCommand, nil)
+	}
+}
+
+func (s *SocksServer) negotiate(c net.Conn) error {
+	var head [2]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socksVersion {
+		return fmt.Errorf("SOCKS version %d not supported", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+	want := byte(socksAuthNone)
+	if s.User != "" {
+		want = socksAuthPass
+	}
+	for _, m := range methods {
+		if m == want {
+			c.Write([]byte{socksVersion, want})
+			if want == socksAuthPass {
+				return s.authenticate(c)
+			}
+			return nil
+		}
+	}
+	c.Write([]byte{socksVersion, socksNoMethod})
+	return errors.New("no acceptable authentication method")
+}
+
+func (s *SocksServer) authenticate(c net.Conn) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return err
+	}
+	user, err := readSocksString(c)
+	if err != nil {
+		return err
+	}
+	password, err := readSocksString(c)
+	if err != nil {
+		return err
+	}
+	if ver[0] != 1 || user != s.User || password != s.Password {
+		c.Write([]byte{1, 1})
+		return fmt.Errorf("authentication failed for %q", user)
+	}
+	_, err = c.Write([]byte{1, 0})
+	return err
+}
+
+// associate serves a UDP ASSOCIATE request. Datagrams from the client are
+// sent through the transport, one flow per destination, and the association
+// ends when the client closes the control connection.
+func (s *SocksServer) associate(c net.Conn) {
+	local := c.LocalAddr().(*net.TCPAddr)
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeSocksReply(c, socksFailure, nil)
+		return
+	}
+	defer udp.Close()
+	writeSocksReply(c, socksOK, udp.LocalAddr().(*net.UDPAddr))
+
+	client := c.RemoteAddr().(*net.TCPAddr)
+	var clientAddr *net.UDPAddr
+	var mu sync.Mutex
+	flows := map[string]net.Conn{}
+	defer func() {
+		mu.Lock()
+		for _, flow := range flows {
+			flow.Close()
+		}
+		mu.Unlock()
+	}()
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !from.IP.Equal(client.IP) || n < 4 || buf[2] != 0 {
+				// not from the client, or fragmented which is not supported
+				continue
+			}
+			host, port, hlen, err := parseSocksAddr(buf[3:n])
+			if err != nil {
+				continue
+			}
+			addr := joinHostPort(host, port)
+			payload := buf[3+hlen : n]
+
+			mu.Lock()
+			clientAddr = from
+			flow := flows[addr]
+			mu.Unlock()
+			if flow == nil {
+				mu.Lock()
+				full := len(flows) >= *udpMaxFlows
+				mu.Unlock()
+				if full {
+					log.Printf("socks udp %s: %d flows open, dropped", addr, *udpMaxFlows)
+					continue
+				}
+				if flow, err = s.Transport.Dial("udp", addr); err != nil {
+					log.Printf("socks udp %s: %v", addr, err)
+					continue
+				}
+				mu.Lock()
+				flows[addr] = flow
+				mu.Unlock()
+				go func(addr string, flow net.Conn) {
+					header := appendSocksAddr([]byte{0, 0, 0}, host, port)
+					reply := make([]byte, maxDatagram)
+					for {
+						n, err := readIdle(flow, reply, udpIdle())
+						if err != nil {
+							break
+						}
+						mu.Lock()
+						to := clientAddr
+						mu.Unlock()
+						udp.WriteToUDP(append(header[:len(header):len(header)], reply[:n]...), to)
+					}
+					mu.Lock()
+					delete(flows, addr)
+					mu.Unlock()
+					flow.Close()
+				}(addr, flow)
+			}
+			flow.Write(payload)
+		}
+	}()
+
+	// the association lives as long as the control connection
+	io.Copy(ioutil.Discard, c)
+}
+
+// readIdle reads from c, failing when nothing arrives within idle. The
+// transport connections have no deadlines so the wait is done here.
+func readIdle(c net.Conn, b []byte, idle time.Duration) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := c.Read(b)
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-time.After(idle):
+		c.Close()
+		<-done
+		return 0, errors.New("idle timeout")
+	}
+}
+
+// relay copies between a and b in both directions until one side is done.
+func relay(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func readSocksString(r io.Reader) (string, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, size[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func readSocksAddr(r io.Reader) (string, int, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, 4)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		name, err := readSocksString(r)
+		if err != nil {
+			return "", 0, err
+		}
+		host = name
+	default:
+		return "", 0, fmt.Errorf("address type %d not supported", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// parseSocksAddr parses the address at the start of b and returns its length.
+func parseSocksAddr(b []byte) (string, int, int, error) {
+	r := &countReader{b: b}
+	host, port, err := readSocksAddr(r)
+	return host, port, r.n, err
+}
+
+type countReader struct {
+	b []byte
+	n int
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	if r.n >= len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.n:])
+	r.n += n
+	return n, nil
+}
+
+func appendSocksAddr(b []byte, host string, port int) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, socksAtypIPv4), ip4...)
+		} else {
+			b = append(append(b, socksAtypIPv6), ip.To16()...)
+		}
+	} else {
+		b = append(append(b, socksAtypDomain, byte(len(host))), host...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+func writeSocksReply(w io.Writer, rep byte, bound *net.UDPAddr) error {
+	host, port := "0.0.0.0", 0
+	if bound != nil {
+		host, port = bound.IP.String(), bound.Port
+	}
+	_, err := w.Write(appendSocksAddr([]byte{socksVersion, rep, 0}, host, port))
+	return err
+}
+
+// socksTransport dials through a SOCKS5 server at the near end of the
+// tunnel, which is how the shadowsocks transport is used: ss-local serves
+// SOCKS5 and carries both TCP and UDP to the ss-server allocated by the
+// Server.
+type socksTransport struct {
+	addr string
+}
+
+func (t socksTransport) Dial(network string, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := net.Dial("tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	cmd, reqHost, reqPort := byte(socksConnect), host, port
+	if network[:3] == "udp" {
+		cmd, reqHost, reqPort = socksAssociate, "0.0.0.0", 0
+	}
+	bound, err := socksRequest(c, cmd, reqHost, reqPort)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if cmd == socksConnect {
+		return c, nil
+	}
+
+	if bound.IP == nil || bound.IP.IsUnspecified() {
+		bound.IP = c.RemoteAddr().(*net.TCPAddr).IP
+	}
+	udp, err := net.DialUDP("udp", nil, bound)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &socksUDPConn{UDPConn: udp, control: c, header: appendSocksAddr([]byte{0, 0, 0}, host, port)}, nil
+}
+
+func socksRequest(c net.Conn, cmd byte, host string, port int) (*net.UDPAddr, error) {
+	if _, err := c.Write([]byte{socksVersion, 1, socksAuthNone}); err != nil {
+		return nil, err
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(c, method[:]); err != nil {
+		return nil, err
+	}
+	if method[1] != socksAuthNone {
+		return nil, errors.New("SOCKS server wants authentication")
+	}
+	if _, err := c.Write(appendSocksAddr([]byte{socksVersion, cmd, 0}, host, port)); err != nil {
+		return nil, err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return nil, err
+	}
+	boundHost, boundPort, err := readSocksAddr(c)
+	if err != nil {
+		return nil, err
+	}
+	if reply[1] != socksOK {
+		return nil, fmt.Errorf("SOCKS request failed with code %d", reply[1])
+	}
+	return &net.UDPAddr{IP: net.ParseIP(boundHost), Port: boundPort}, nil
+}
+
+// socksUDPConn is one UDP flow through a SOCKS5 UDP association.
+type socksUDPConn struct {
+	*net.UDPConn
+	control net.Conn
+	header  []byte
+}
+
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 {
+			continue
+		}
+		_, _, hlen, err := parseSocksAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[3+hlen:n]), nil
+	}
+}
+
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	if _, err := c.UDPConn.Write(append(c.header[:len(c.header):len(c.header)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksUDPConn) Close() error {
+	c.control.Close()
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeTransport records the addresses dialed and answers them with an echo.
+type fakeTransport struct {
+	dialed chan string
+}
+
+func (t fakeTransport) Dial(network string, addr string) (net.Conn, error) {
+	t.dialed <- addr
+	if addr == "refused:1" {
+		return nil, errors.New("connection refused")
+	}
+	near, far := net.Pipe()
+	go func() {
+		io.Copy(far, far)
+		far.Close()
+	}()
+	return near, nil
+}
+
+func startSocksServer(t *testing.T, user string, password string) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	dialed := make(chan string, 1)
+	server := &SocksServer{fakeTransport{dialed}, user, password}
+	go server.Serve(l)
+	return l.Addr().String(), dialed
+}
+
+func TestSocksHandshake(t *testing.T) {
+	connect := func(addr ...byte) []byte {
+		return append([]byte{socksVersion, socksConnect, 0}, addr...)
+	}
+	ok := []byte{socksVersion, socksOK, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		send     [][]byte
+		want     []byte
+		dialed   string
+		echo     bool
+	}{
+		{"IPv4", "", "", [][]byte{{5, 1, socksAuthNone}, connect(socksAtypIPv4, 10, 0, 0, 1, 0, 80)},
+			append([]byte{5, socksAuthNone}, ok...), "10.0.0.1:80", true},
+		{"domain", "", "", [][]byte{{5, 2, socksAuthPass, socksAuthNone}, connect(socksAtypDomain, 3, 'w', 'e', 'b', 0x1f, 0x90)},
+			append([]byte{5, socksAuthNone}, ok...), "web:8080", true},
+		{"IPv6", "", "", [][]byte{{5, 1, socksAuthNone}, connect(append(append([]byte{socksAtypIPv6}, net.ParseIP("fd00::1")...), 0, 22)...)},
+			append([]byte{5, socksAuthNone}, ok...), "[fd00::1]:22", true},
+		{"password", "user", "secret", [][]byte{{5, 2, socksAuthNone, socksAuthPass}, []byte("\x01\x04user\x06secret"), connect(socksAtypIPv4, 10, 0, 0, 1, 0, 80)},
+			append([]byte{5, socksAuthPass, 1, 0}, ok...), "10.0.0.1:80", true},
+		{"wrong password", "user", "secret", [][]byte{{5, 1, socksAuthPass}, []byte("\x01\x04user\x05guess")},
+			[]byte{5, socksAuthPass, 1, 1}, "", false},
+		{"wrong auth version", "user", "secret", [][]byte{{5, 1, socksAuthPass}, []byte("\x02\x04user\x06secret")},
+			[]byte{5, socksAuthPass, 1, 1}, "", false},
+		{"password required", "user", "secret", [][]byte{{5, 1, socksAuthNone}},
+			[]byte{5, socksNoMethod}, "", false},
+		{"bind not supported", "", "", [][]byte{{5, 1, socksAuthNone}, {5, 2, 0, socksAtypIPv4, 10, 0, 0, 1, 0, 80}},
+			[]byte{5, socksAuthNone, 5, socksBadCommand, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}, "", false},
+		{"bad address type", "", "", [][]byte{{5, 1, socksAuthNone}, connect(9, 0, 0)},
+			[]byte{5, socksAuthNone, 5, socksBadAddrType, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}, "", false},
+		{"refused", "", "", [][]byte{{5, 1, socksAuthNone}, connect(socksAtypDomain, 7, 'r', 'e', 'f', 'u', 's', 'e', 'd', 0, 1)},
+			[]byte{5, socksAuthNone, 5, socksRefused, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}, "refused:1", false},
+	}
+	for _, test := range tests {
+		addr, dialed := startSocksServer(t, test.user, test.password)
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		for _, b := range test.send {
+			c.Write(b)
+		}
+		got := make([]byte, len(test.want))
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: reply % x, %v, want % x", test.name, got, err, test.want)
+		}
+		select {
+		case addr := <-dialed:
+			if addr != test.dialed {
+				t.Errorf("%s: dialed %s, want %s", test.name, addr, test.dialed)
+			}
+		default:
+			if test.dialed != "" {
+				t.Errorf("%s: %s not dialed", test.name, test.dialed)
+			}
+		}
+		if test.echo {
+			c.Write([]byte("ping"))
+			echo := make([]byte, 4)
+			if _, err := io.ReadFull(c, echo); err != nil || string(echo) != "ping" {
+				t.Errorf("%s: relayed %q, %v", test.name, echo, err)
+			}
+		} else if n, err := c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: %d more bytes after the reply", test.name, n)
+		}
+		c.Close()
+	}
+}
+
+// the transport of the Client against its own server
+func TestSocksTransport(t *testing.T) {
+	addr, dialed := startSocksServer(t, "", "")
+	c, err := socksTransport{addr}.Dial("tcp", "[fd00::1]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := <-dialed; got != "[fd00::1]:443" {
+		t.Errorf("dialed %s", got)
+	}
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(c, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("relayed %q, %v", echo, err)
+	}
+
+	addr, _ = startSocksServer(t, "user", "secret")
+	if _, err := (socksTransport{addr}).Dial("tcp", "web:80"); err == nil {
+		t.Errorf("dialed through a server wanting a password")
+	}
+}
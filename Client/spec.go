@@ -0,0 +1,279 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TunnelSpec is the "port:host:port" argument of forward and remote. An IPv6
+// host is written in brackets, "8080:[fd00::1]:80", like ssh expects it.
+// Either end may instead be the absolute path of a Unix socket, e.g.
+// "2375:/var/run/docker.sock" or "/tmp/pg.sock:db:5432". A listening port
+// may be preceded by the address to bind, e.g. "[::1]:8080:host:80".
+type TunnelSpec struct {
+	Bind       string
+	Port       int
+	Socket     string
+	Host       string
+	HostPort   int
+	HostSocket string
+}
+
+func (t TunnelSpec) String() string {
+	if t.Socket != "" {
+		return fmt.Sprintf("%s:%s", t.Socket, t.Target())
+	}
+	if t.Bind != "" {
+		return fmt.Sprintf("%s:%s", joinHostPort(t.Bind, t.Port), t.Target())
+	}
+	return fmt.Sprintf("%d:%s", t.Port, t.Target())
+}
+
+// Target is the far end of the tunnel, host:port or a socket path.
+func (t TunnelSpec) Target() string {
+	if t.HostSocket != "" {
+		return t.HostSocket
+	}
+	return joinHostPort(t.Host, t.HostPort)
+}
+
+var hostnameRe = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("bad port %q", s)
+	}
+	return port, nil
+}
+
+// parseHostPort parses "host:port" where host is a name, an IPv4 address or
+// a bracketed IPv6 address. The host is returned without brackets.
+func parseHostPort(s string) (string, int, error) {
+	var host, port string
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing ] in %q", s)
+		}
+		host = s[1:end]
+		if net.ParseIP(host) == nil || !strings.Contains(host, ":") {
+			return "", 0, fmt.Errorf("bad IPv6 address %q", host)
+		}
+		if !strings.HasPrefix(s[end+1:], ":") {
+			return "", 0, fmt.Errorf("missing port in %q", s)
+		}
+		port = s[end+2:]
+	} else {
+		i := strings.Index(s, ":")
+		if i < 0 {
+			return "", 0, fmt.Errorf("missing port in %q", s)
+		}
+		host, port = s[:i], s[i+1:]
+		if strings.Contains(port, ":") {
+			return "", 0, fmt.Errorf("IPv6 addresses must be in brackets, e.g. [::1]:80, in %q", s)
+		}
+		if !hostnameRe.MatchString(host) {
+			return "", 0, fmt.Errorf("bad host %q", host)
+		}
+	}
+	p, err := parsePort(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, p, nil
+}
+
+func joinHostPort(host string, port int) string {
+	if strings.Contains(host, ":") {
+		return fmt.Sprintf("[%s]:%d", host, port)
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
+
+// parseSocketPath checks the path of a Unix socket. ssh tells a socket from
+// a port by the slash, and cannot take a path with a colon.
+func parseSocketPath(s string) (string, error) {
+	if !strings.HasPrefix(s, "/") {
+		return "", fmt.Errorf("socket path %q is not absolute", s)
+	}
+	if strings.ContainsAny(s, ": \t") {
+		return "", fmt.Errorf("bad socket path %q", s)
+	}
+	return s, nil
+}
+
+// parseTarget parses the far end of a tunnel, host:port or the path of a
+// Unix socket, into a TunnelSpec without the listening end.
+func parseTarget(s string) (TunnelSpec, error) {
+	if strings.HasPrefix(s, "/") {
+		socket, err := parseSocketPath(s)
+		return TunnelSpec{HostSocket: socket}, err
+	}
+	host, port, err := parseHostPort(s)
+	return TunnelSpec{Host: host, HostPort: port}, err
+}
+
+// parseBind parses the address a tunnel listens on: an IP address,
+// "localhost" or "*" for every address.
+func parseBind(s string) (string, error) {
+	if s == "localhost" || s == "*" || net.ParseIP(s) != nil {
+		return s, nil
+	}
+	return "", fmt.Errorf("bad bind address %q", s)
+}
+
+// publicBind tells if a tunnel bound to addr can be reached from the network,
+// which needs --allow-public.
+func publicBind(addr string) bool {
+	if addr == "" || addr == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	return ip == nil || !ip.IsLoopback()
+}
+
+func checkBind(addr string) error {
+	if publicBind(addr) && !bAllowPublic {
+		return fmt.Errorf("binding to %s opens the tunnel to the network, add --allow-public", addr)
+	}
+	return nil
+}
+
+func parseTunnelSpec(s string) (TunnelSpec, error) {
+	var bind string
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]:")
+		if end < 0 {
+			return TunnelSpec{}, fmt.Errorf("missing ]: in %q", s)
+		}
+		bind, s = s[1:end], s[end+2:]
+	} else if i := strings.Index(s, ":"); i > 0 && !strings.HasPrefix(s, "/") {
+		if _, err := strconv.Atoi(s[:i]); err != nil {
+			bind, s = s[:i], s[i+1:]
+		}
+	}
+
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return TunnelSpec{}, fmt.Errorf("expected port:host:port, got %q", s)
+	}
+	spec, err := parseTarget(s[i+1:])
+	if err != nil {
+		return TunnelSpec{}, err
+	}
+	if bind != "" {
+		if spec.Bind, err = parseBind(bind); err != nil {
+			return TunnelSpec{}, err
+		}
+	}
+	if strings.HasPrefix(s, "/") {
+		if bind != "" {
+			return TunnelSpec{}, fmt.Errorf("a Unix socket has no bind address, in %q", s)
+		}
+		spec.Socket, err = parseSocketPath(s[:i])
+	} else {
+		spec.Port, err = parsePort(s[:i])
+	}
+	if err != nil {
+		return TunnelSpec{}, err
+	}
+	return spec, nil
+}
+
+// forwardedTo returns the recorded forward to target listening on bind, if
+// there is one.
+func forwardedTo(bind string, target string) (TunnelSpec, bool) {
+	records, _ := readTunnelRecords(tunnelListFile)
+	for _, record := range records {
+		if record.Kind != "Forward" {
+			continue
+		}
+		spec, err := parseTunnelSpec(record.Spec)
+		if err == nil && spec.Bind == bind && spec.Target() == target {
+			return spec, true
+		}
+	}
+	return TunnelSpec{}, false
+}
+
+func validateTunnelSpec(args []string) error {
+	spec, err := parseTunnelSpec(args[0])
+	if err == nil {
+		err = checkBind(spec.Bind)
+	}
+	return err
+}
+
+// validateUDPSpec is validateTunnelSpec for datagrams, which have no Unix
+// socket ends.
+func validateUDPSpec(args []string) error {
+	spec, err := parseTunnelSpec(args[0])
+	if err == nil && (spec.Socket != "" || spec.HostSocket != "") {
+		err = fmt.Errorf("UDP tunnels cannot use Unix sockets")
+	}
+	if err == nil && spec.Bind != "" {
+		err = fmt.Errorf("UDP tunnels are bound with --bind")
+	}
+	return err
+}
+
+func validateHostPort(args []string) error {
+	_, _, err := parseHostPort(args[0])
+	return err
+}
+
+func validateTarget(args []string) error {
+	_, err := parseTarget(args[0])
+	return err
+}
+
+// validateAutoremote rejects the old "<remote port:host>" form of autoremote,
+// which forwarded a given port of the proxy to a free local one, as its
+// meaning has turned around.
+func validateAutoremote(args []string) error {
+	fields := strings.Split(args[0], ":")
+	if len(fields) == 2 {
+		if _, err := parsePort(fields[0]); err == nil {
+			if _, err := parsePort(fields[1]); err != nil {
+				return fmt.Errorf("autoremote takes <host:local port> and picks the port on the proxy, for the old <remote port:host> use remote %s:<local port>", args[0])
+			}
+		}
+	}
+	return validateTarget(args)
+}
+
+func validateOptionalPort(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	_, err := parsePort(args[0])
+	return err
+}
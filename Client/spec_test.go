@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestValidateAutoremote(t *testing.T) {
+	tests := []struct {
+		arg string
+		ok  bool
+	}{
+		{"web:8080", true},
+		{"localhost:22", true},
+		{"[::1]:22", true},
+		{"/tmp/app.sock", true},
+		{"8080:web", false},
+		{"8080", false},
+	}
+	for _, test := range tests {
+		if err := validateAutoremote([]string{test.arg}); (err == nil) != test.ok {
+			t.Errorf("validateAutoremote(%q) = %v", test.arg, err)
+		}
+	}
+}
+
+func TestParseTunnelSpec(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want TunnelSpec
+		ok   bool
+	}{
+		{"8080:web:80", TunnelSpec{Port: 8080, Host: "web", HostPort: 80}, true},
+		{"8080:[fd00::1]:80", TunnelSpec{Port: 8080, Host: "fd00::1", HostPort: 80}, true},
+		{"2375:/var/run/docker.sock", TunnelSpec{Port: 2375, HostSocket: "/var/run/docker.sock"}, true},
+		{"/tmp/pg.sock:db:5432", TunnelSpec{Socket: "/tmp/pg.sock", Host: "db", HostPort: 5432}, true},
+		{"/tmp/a.sock:/tmp/b.sock", TunnelSpec{Socket: "/tmp/a.sock", HostSocket: "/tmp/b.sock"}, true},
+		{"[::1]:8080:host:80", TunnelSpec{Bind: "::1", Port: 8080, Host: "host", HostPort: 80}, true},
+		{"127.0.0.1:8080:host:80", TunnelSpec{Bind: "127.0.0.1", Port: 8080, Host: "host", HostPort: 80}, true},
+		{"*:8080:host:80", TunnelSpec{Bind: "*", Port: 8080, Host: "host", HostPort: 80}, true},
+		{"localhost:8080:host:80", TunnelSpec{Bind: "localhost", Port: 8080, Host: "host", HostPort: 80}, true},
+		{"8080", TunnelSpec{}, false},
+		{"8080:web", TunnelSpec{}, false},
+		{"0:web:80", TunnelSpec{}, false},
+		{"8080:web:70000", TunnelSpec{}, false},
+		{"8080:fd00::1:80", TunnelSpec{}, false},
+		{"8080:[web]:80", TunnelSpec{}, false},
+		{"[::1:8080:host:80", TunnelSpec{}, false},
+		{"nohost:8080:host:80", TunnelSpec{}, false},
+		{"[::1]:/tmp/a.sock:host:80", TunnelSpec{}, false},
+		{"tmp/a.sock:host:80", TunnelSpec{}, false},
+		{"8080:/tmp/a b.sock", TunnelSpec{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseTunnelSpec(test.arg)
+		if (err == nil) != test.ok {
+			t.Errorf("parseTunnelSpec(%q) error = %v", test.arg, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseTunnelSpec(%q) = %+v, want %+v", test.arg, got, test.want)
+		}
+		if again, err := parseTunnelSpec(got.String()); err != nil || again != got {
+			t.Errorf("parseTunnelSpec(%q) = %+v, %v, does not round trip", got.String(), again, err)
+		}
+	}
+}
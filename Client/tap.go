@@ -0,0 +1,158 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// tapName is the name the Server knows this instance by.
+func tapName() string {
+	return fmt.Sprintf("%s_%d", userName, *instance)
+}
+
+// serverRequest calls the web API of the Server through the transport, e.g.
+// "allocate/<signum>_<instance>".
+func serverRequest(t Transport, path string) (TAPinfo, error) {
+	var info TAPinfo
+	client := &http.Client{Transport: &http.Transport{Dial: t.Dial}}
+	resp, err := client.Get(fmt.Sprintf("http://%s/%s", *tapServer, path))
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return info, err
+	}
+	if info.Status != "OK" {
+		return info, fmt.Errorf("server: %s", info.Reason)
+	}
+	return info, nil
+}
+
+func runIP(arg ...string) error {
+	output, err := exec.Command(*ipbin, arg...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", *ipbin, strings.Join(arg, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// tapRoutes returns the subnets routed over the tap device.
+func tapRoutes() []string {
+	var routes []string
+	for _, route := range strings.Split(*tapRouteList, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// serveTap allocates a tap on the Server, creates the local device with the
+// allocated address and the configured routes, and bridges the ethernet
+// frames of the two devices over the transport until the connection to the
+// Server's tapdaemon ends or the process is stopped.
+func serveTap(t Transport, device string) error {
+	info, err := serverRequest(t, "allocate/"+tapName())
+	if err != nil {
+		return err
+	}
+	defer serverRequest(t, "remove/"+tapName())
+
+	dev, name, err := openTap(device)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	if err := runIP("addr", "add", fmt.Sprintf("%s/%d", info.Ip, *tapPrefix), "dev", name); err != nil {
+		return err
+	}
+	if info.Ip6 != "" {
+		if err := runIP("-6", "addr", "add", fmt.Sprintf("%s/%d", info.Ip6, *tapPrefix6), "dev", name); err != nil {
+			return err
+		}
+	}
+	if err := runIP("link", "set", name, "up"); err != nil {
+		return err
+	}
+	for _, route := range tapRoutes() {
+		if err := runIP("route", "add", route, "dev", name); err != nil {
+			return err
+		}
+	}
+
+	// the tapdaemon of the Server serves the far device on its port, one
+	// ethernet frame per record of framedConn, see Tapdaemon/main.go
+	conn, err := t.Dial("tcp", fmt.Sprintf("localhost:%d", info.Port))
+	if err != nil {
+		return err
+	}
+	stream := &framedConn{Conn: conn}
+	defer stream.Close()
+
+	daemonReady(name, nil)
+	log.Printf("%s bridged to %s %s on %s", name, info.Tap, info.Ip, *proxyServerAddr)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	errc := make(chan error, 2)
+	go func() {
+		errc <- copyFrames(stream, dev)
+	}()
+	go func() {
+		errc <- copyFrames(dev, stream)
+	}()
+	select {
+	case err = <-errc:
+	case <-stop:
+	}
+	return err
+}
+
+// copyFrames copies one frame per read, as a tap device and a framedConn
+// both read and write whole frames.
+func copyFrames(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Transport carries connections through the attached tunnel to the far side
+// of the proxy. The network is "tcp" or "udp", and for "udp" every Read and
+// Write of the returned connection is one datagram.
+type Transport interface {
+	Dial(network string, addr string) (net.Conn, error)
+}
+
+// newTransport returns the transport selected by the transport option.
+func newTransport() (Transport, error) {
+	switch *transportName {
+	case "ssh":
+		return sshTransport{}, nil
+	case "shadowsocks":
+		return socksTransport{*shadowsocksLocal}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %s", *transportName)
+}
+
+// sshTransport dials through the ssh master connection. TCP uses the stdio
+// forwarding of ssh -W. UDP has no ssh channel of its own, so the datagrams
+// are framed over the stdio of the udprelay command run on the proxy.
+type sshTransport struct{}
+
+func (sshTransport) Dial(network string, addr string) (net.Conn, error) {
+	var cmd *exec.Cmd
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		cmd = sshCommand("-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), "-W", addr, *proxyServerAddr)
+	case "udp", "udp4", "udp6":
+		cmd = sshCommand("-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr, *remoteClient+" udprelay "+addr)
+	default:
+		return nil, fmt.Errorf("network %s not supported", network)
+	}
+	c, err := startCmdConn(cmd, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network[:3] == "udp" {
+		return &framedConn{Conn: c}, nil
+	}
+	return c, nil
+}
+
+// cmdConn is a connection over the stdin and stdout of a command.
+type cmdConn struct {
+	cmd  *exec.Cmd
+	r    io.ReadCloser
+	w    io.WriteCloser
+	addr string
+}
+
+func startCmdConn(cmd *exec.Cmd, addr string) (*cmdConn, error) {
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdConn{cmd, r, w, addr}, nil
+}
+
+func (c *cmdConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *cmdConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *cmdConn) Close() error {
+	c.w.Close()
+	c.r.Close()
+	c.cmd.Process.Kill()
+	return c.cmd.Wait()
+}
+
+func (c *cmdConn) LocalAddr() net.Addr  { return tunnelAddr("local") }
+func (c *cmdConn) RemoteAddr() net.Addr { return tunnelAddr(c.addr) }
+
+// Deadlines are not supported on pipes to ssh, users of the transport time
+// out by closing the connection instead.
+func (c *cmdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// maxDatagram is the largest datagram carried through the tunnel.
+const maxDatagram = 65535
+
+// framedConn carries datagrams over a stream, each one prefixed by its
+// length as two bytes in network order.
+type framedConn struct {
+	net.Conn
+}
+
+func (c *framedConn) Read(b []byte) (int, error) {
+	var size uint16
+	if err := binary.Read(c.Conn, binary.BigEndian, &size); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	return copy(b, buf), nil
+}
+
+func (c *framedConn) Write(b []byte) (int, error) {
+	if len(b) > maxDatagram {
+		return 0, errors.New("datagram too large")
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// relayUDP runs on the proxy as the far end of a UDP tunnel of the ssh
+// transport. Framed datagrams from stdin are sent to addr and the replies
+// are framed on stdout, until stdin is closed or the flow is idle.
+func relayUDP(addr string, idle time.Duration) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream := &framedConn{Conn: stdioConn{}}
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := stream.Read(buf)
+			if err != nil {
+				errc <- nil
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(idle))
+			if _, err := conn.Write(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxDatagram)
+		conn.SetReadDeadline(time.Now().Add(idle))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					errc <- nil
+				} else {
+					errc <- err
+				}
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(idle))
+			if _, err := stream.Write(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return <-errc
+}
+
+// stdioConn is the stdin and stdout of this process as a connection.
+type stdioConn struct {
+	net.Conn
+}
+
+func (stdioConn) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (stdioConn) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
@@ -0,0 +1,251 @@
+/*
+Tunneling Recursice Router Client
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpIdle returns how long a UDP flow may be quiet before it is closed.
+func udpIdle() time.Duration {
+	return time.Duration(*udpTimeout) * time.Second
+}
+
+// udpFlows tracks the flows of a UDP tunnel by the address of the peer
+// that started them.
+type udpFlows struct {
+	mu    sync.Mutex
+	flows map[string]net.Conn
+}
+
+func newUDPFlows() *udpFlows {
+	return &udpFlows{flows: map[string]net.Conn{}}
+}
+
+func (f *udpFlows) get(key string) net.Conn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flows[key]
+}
+
+// full tells if the tunnel has as many flows as udpMaxFlows allows, each
+// one being a connection of the transport, an ssh process for ssh.
+func (f *udpFlows) full() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.flows) >= *udpMaxFlows
+}
+
+func (f *udpFlows) add(key string, c net.Conn) {
+	f.mu.Lock()
+	f.flows[key] = c
+	f.mu.Unlock()
+}
+
+func (f *udpFlows) remove(key string, c net.Conn) {
+	f.mu.Lock()
+	if f.flows[key] == c {
+		delete(f.flows, key)
+	}
+	f.mu.Unlock()
+	c.Close()
+}
+
+// serveForwardUDP forwards the datagrams arriving on pc through the
+// transport to addr behind the proxy. Each source address gets a flow of its
+// own, so replies go back to the right peer, and flows end when idle.
+func serveForwardUDP(pc *net.UDPConn, t Transport, addr string, idle time.Duration) error {
+	flows := newUDPFlows()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		key := from.String()
+		flow := flows.get(key)
+		if flow == nil {
+			if flows.full() {
+				log.Printf("udp %s to %s: %d flows open, dropped", key, addr, *udpMaxFlows)
+				continue
+			}
+			if flow, err = t.Dial("udp", addr); err != nil {
+				log.Printf("udp %s to %s: %v", key, addr, err)
+				continue
+			}
+			flows.add(key, flow)
+			go func(key string, flow net.Conn, from *net.UDPAddr) {
+				defer flows.remove(key, flow)
+				reply := make([]byte, maxDatagram)
+				for {
+					n, err := readIdle(flow, reply, idle)
+					if err != nil {
+						return
+					}
+					pc.WriteToUDP(reply[:n], from)
+				}
+			}(key, flow, from)
+		}
+		if _, err := flow.Write(buf[:n]); err != nil {
+			flows.remove(key, flow)
+		}
+	}
+}
+
+// serveRemoteUDP is the near end of remote-udp. The stream carries the
+// datagrams received by udplisten on the proxy, each prefixed with the
+// address of its sender, and they are sent on to addr from a socket per
+// sender. Replies go back over the stream with the same prefix.
+func serveRemoteUDP(stream net.Conn, addr string, idle time.Duration) error {
+	flows := newUDPFlows()
+	var wmu sync.Mutex
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := stream.Read(buf)
+		if err != nil {
+			return err
+		}
+		host, port, hlen, err := parseSocksAddr(buf[:n])
+		if err != nil {
+			continue
+		}
+		key := joinHostPort(host, port)
+		flow := flows.get(key)
+		if flow == nil {
+			if flows.full() {
+				log.Printf("udp %s to %s: %d flows open, dropped", key, addr, *udpMaxFlows)
+				continue
+			}
+			if flow, err = net.Dial("udp", addr); err != nil {
+				log.Printf("udp %s to %s: %v", key, addr, err)
+				continue
+			}
+			flows.add(key, flow)
+			go func(key string, flow net.Conn, header []byte) {
+				defer flows.remove(key, flow)
+				reply := make([]byte, maxDatagram)
+				for {
+					flow.SetReadDeadline(time.Now().Add(idle))
+					n, err := flow.Read(reply)
+					if err != nil {
+						return
+					}
+					if len(header)+n > maxDatagram {
+						log.Printf("udp %s: datagram of %d bytes too large, dropped", key, n)
+						continue
+					}
+					wmu.Lock()
+					stream.Write(append(header[:len(header):len(header)], reply[:n]...))
+					wmu.Unlock()
+				}
+			}(key, flow, appendSocksAddr(nil, host, port))
+		}
+		flow.Write(buf[hlen:n])
+	}
+}
+
+// udpListen is the far end of remote-udp, run on the proxy. Datagrams
+// received on port are framed on stdout with the address of the sender, and
+// framed datagrams from stdin are sent to the address they are prefixed with.
+func udpListen(port string) error {
+	pc, err := net.ListenPacket("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	stream := &framedConn{Conn: stdioConn{}}
+	// an empty datagram tells the Client that the port is bound
+	if _, err := stream.Write(nil); err != nil {
+		return err
+	}
+	errc := make(chan error, 2)
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := stream.Read(buf)
+			if err != nil {
+				errc <- nil
+				return
+			}
+			host, p, hlen, err := parseSocksAddr(buf[:n])
+			if err != nil {
+				continue
+			}
+			to, err := net.ResolveUDPAddr("udp", joinHostPort(host, p))
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(buf[hlen:n], to)
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			udpFrom := from.(*net.UDPAddr)
+			frame := appendSocksAddr(nil, udpFrom.IP.String(), udpFrom.Port)
+			// the frame holds the address too, a datagram near the limit
+			// is dropped rather than ending the tunnel
+			if len(frame)+n > maxDatagram {
+				log.Printf("udp %s: datagram of %d bytes too large, dropped", from, n)
+				continue
+			}
+			if _, err := stream.Write(append(frame, buf[:n]...)); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	return <-errc
+}
+
+// dialRemoteUDP starts udplisten on the proxy for remote-udp. It needs the
+// ssh transport, as shadowsocks can't listen on the far side.
+func dialRemoteUDP(port int) (net.Conn, error) {
+	if *transportName != "ssh" {
+		return nil, fmt.Errorf("remote-udp needs the ssh transport")
+	}
+	cmd := sshCommand("-o", fmt.Sprintf("ControlPath=%s", ctrlSocket), *proxyServerAddr,
+		fmt.Sprintf("%s udplisten %d", *remoteClient, port))
+	c, err := startCmdConn(cmd, fmt.Sprintf("%s:%d", *proxyServerAddr, port))
+	if err != nil {
+		return nil, err
+	}
+	stream := &framedConn{Conn: c}
+	if _, err := readIdle(stream, make([]byte, 1), daemonTimeout); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("udplisten %d failed on %s", port, *proxyServerAddr)
+	}
+	return stream, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestFramedConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sender, receiver := &framedConn{Conn: a}, &framedConn{Conn: b}
+
+	datagrams := [][]byte{[]byte("ping"), {}, bytes.Repeat([]byte{7}, maxDatagram)}
+	go func() {
+		for _, d := range datagrams {
+			sender.Write(d)
+		}
+	}()
+	buf := make([]byte, maxDatagram)
+	for _, want := range datagrams {
+		n, err := receiver.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], want) {
+			t.Fatalf("read %d bytes, %v, want %d bytes", n, err, len(want))
+		}
+	}
+	if _, err := sender.Write(make([]byte, maxDatagram+1)); err == nil {
+		t.Error("datagram over maxDatagram written")
+	}
+}
+
+func TestUDPFlowsFull(t *testing.T) {
+	*udpMaxFlows = 2
+	defer func() { *udpMaxFlows = 64 }()
+	flows := newUDPFlows()
+	for i, key := range []string{"a", "b"} {
+		if flows.full() {
+			t.Fatalf("full after %d flows", i)
+		}
+		c, _ := net.Pipe()
+		flows.add(key, c)
+	}
+	if !flows.full() {
+		t.Error("not full at udpMaxFlows")
+	}
+	flows.remove("a", flows.get("a"))
+	if flows.full() {
+		t.Error("full after a flow was removed")
+	}
+}
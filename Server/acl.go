@@ -0,0 +1,403 @@
+/*
+Tunneling Recursive Router
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An ACL limits where the traffic of an allocation may go. The config has
+//
+//   [group.<name>]
+//   members = "alice bob"
+//
+//   [acl.<user or group>]
+//   allow = "10.0.0.0/8 192.168.1.0/24:22,80,8000-8100 [fd00::/64]:443"
+//
+// An allocation <user>_<instance> gets the destinations allowed to the user
+// and to all its groups, or those of [acl.default] if none of them has an
+// ACL. Without any [acl.*] section the traffic is not restricted.
+//
+// The ACL holds both for the traffic routed from the tap and for the
+// connections ss-server makes for the allocation, which runs in a cgroup of
+// its own under cgroupRoot so that iptables can tell its sockets apart. The
+// names ss-server resolves go through the resolver of the host, which the
+// ACL must then allow as well.
+type ACL struct {
+	Rules []ACLRule
+}
+
+// ACLRule allows a network, on the given tcp and udp ports or on all ports
+// and protocols if there are none.
+type ACLRule struct {
+	Net   *net.IPNet
+	Ports []string
+}
+
+var aclAllow = map[string]*string{}
+var groupMembers = map[string]*string{}
+
+// aclApplied tells which taps have rules, which may outlive their ACL in a
+// reload
+var aclApplied [256]bool
+
+var aclSectionRe = regexp.MustCompile(`^\s*\[(acl|group)\.([A-Za-z0-9_.-]+)\]`)
+
+// declareACLs scans the config file for [acl.*] and [group.*] sections and
+// declares their options in set before the file is parsed.
+func declareACLs(set optionSet, path string) (map[string]*string, map[string]*string) {
+	acls := map[string]*string{}
+	groups := map[string]*string{}
+	file, err := os.Open(path)
+	if err != nil {
+		return acls, groups
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		result := aclSectionRe.FindStringSubmatch(scanner.Text())
+		if result == nil {
+			continue
+		}
+		switch name := result[2]; result[1] {
+		case "acl":
+			if acls[name] == nil {
+				acls[name] = set.String("acl."+name+".allow", "")
+			}
+		case "group":
+			if groups[name] == nil {
+				groups[name] = set.String("group."+name+".members", "")
+			}
+		}
+	}
+	return acls, groups
+}
+
+// parseACL parses an allow list, entries of network[:ports] separated by
+// spaces, an IPv6 network given in brackets.
+func parseACL(allow string) (*ACL, error) {
+	acl := &ACL{}
+	for _, entry := range strings.Fields(allow) {
+		network, ports := entry, ""
+		if strings.HasPrefix(entry, "[") {
+			end := strings.Index(entry, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("%s: missing ]", entry)
+			}
+			network, ports = entry[1:end], strings.TrimPrefix(entry[end+1:], ":")
+		} else if i := strings.Index(entry, ":"); i >= 0 {
+			network, ports = entry[:i], entry[i+1:]
+		}
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad network", entry)
+		}
+		rule := ACLRule{Net: ipnet}
+		if ports != "" {
+			for _, p := range strings.Split(ports, ",") {
+				if !validPorts(p) {
+					return nil, fmt.Errorf("%s: bad port %s", entry, p)
+				}
+				rule.Ports = append(rule.Ports, p)
+			}
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	return acl, nil
+}
+
+// validPorts checks a port or a range of ports such as 8000-8100
+func validPorts(p string) bool {
+	bounds := strings.SplitN(p, "-", 2)
+	first := 0
+	for _, b := range bounds {
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 1 || n > 65535 || n < first {
+			return false
+		}
+		first = n
+	}
+	return true
+}
+
+// aclFor returns the ACL of an allocation name, nil if it is unrestricted.
+func aclFor(name string) (*ACL, error) {
+	return aclOf(name, aclAllow, groupMembers)
+}
+
+// aclOf returns the ACL of an allocation name from the given ACLs and groups.
+func aclOf(name string, acls map[string]*string, groups map[string]*string) (*ACL, error) {
+	if len(acls) == 0 {
+		return nil, nil
+	}
+	user := name
+	if i := strings.LastIndex(name, "_"); i > 0 {
+		user = name[:i]
+	}
+	owners := []string{user}
+	var memberOf []string
+	for group, members := range groups {
+		for _, member := range strings.Fields(*members) {
+			if member == user {
+				memberOf = append(memberOf, group)
+			}
+		}
+	}
+	sort.Strings(memberOf)
+	owners = append(owners, memberOf...)
+
+	acl := &ACL{}
+	found := false
+	for _, owner := range owners {
+		if allow, ok := acls[owner]; ok {
+			found = true
+			a, err := parseACL(*allow)
+			if err != nil {
+				return nil, fmt.Errorf("acl.%s.allow: %v", owner, err)
+			}
+			acl.Rules = append(acl.Rules, a.Rules...)
+		}
+	}
+	if !found {
+		if allow, ok := acls["default"]; ok {
+			a, err := parseACL(*allow)
+			if err != nil {
+				return nil, fmt.Errorf("acl.default.allow: %v", err)
+			}
+			acl = a
+		}
+	}
+	// an allocation matching no ACL gets an empty one and so nothing passes
+	return acl, nil
+}
+
+// validateACLs parses every ACL, so that a config with a bad one is refused
+// before any allocation gets it.
+func validateACLs(acls map[string]*string) error {
+	var names []string
+	for name := range acls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := parseACL(*acls[name]); err != nil {
+			return fmt.Errorf("acl.%s.allow: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// maxMultiport is how many ports one multiport match takes, a range counting
+// as two.
+const maxMultiport = 15
+
+// multiportGroups splits ports into lists that each fit one multiport match.
+func multiportGroups(ports []string) []string {
+	var groups []string
+	var group []string
+	size := 0
+	for _, p := range ports {
+		n := 1
+		if strings.Contains(p, "-") {
+			n = 2
+		}
+		if size+n > maxMultiport {
+			groups = append(groups, strings.Join(group, ","))
+			group, size = nil, 0
+		}
+		group = append(group, strings.Replace(p, "-", ":", 1))
+		size += n
+	}
+	if len(group) > 0 {
+		groups = append(groups, strings.Join(group, ","))
+	}
+	return groups
+}
+
+// aclRules returns the iptables rules of the chain for the IPv4 or the IPv6
+// networks of the ACL, without the log and drop at the end. Packets of the
+// connections already let through pass, which is also how the replies of
+// ss-server to its clients get out.
+func aclRules(chain string, acl *ACL, ipv4 bool) [][]string {
+	rules := [][]string{{"-A", chain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"}}
+	for _, rule := range acl.Rules {
+		if (rule.Net.IP.To4() != nil) != ipv4 {
+			continue
+		}
+		dest := []string{"-A", chain, "-d", rule.Net.String()}
+		if len(rule.Ports) == 0 {
+			rules = append(rules, append(dest, "-j", "ACCEPT"))
+			continue
+		}
+		for _, ports := range multiportGroups(rule.Ports) {
+			for _, proto := range []string{"tcp", "udp"} {
+				rules = append(rules, append(append([]string{}, dest...), "-p", proto, "-m", "multiport", "--dports", ports, "-j", "ACCEPT"))
+			}
+		}
+	}
+	return rules
+}
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// serverCgroup is the cgroup of the ss-server of a tap, relative to
+// cgroupRoot as iptables takes it
+func serverCgroup(index int) string {
+	return filepath.Join("trr", tapNames[index])
+}
+
+// joinCgroup creates the cgroup of the ss-server of a tap and moves a running
+// ss-server into it. iptables only matches a cgroup that exists.
+func joinCgroup(index int) error {
+	if bDryrun {
+		return nil
+	}
+	dir := filepath.Join(cgroupRoot, serverCgroup(index))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if cmdsServer[index] == nil || cmdsServer[index].Process == nil {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(fmt.Sprintf("%d\n", cmdsServer[index].Process.Pid)), 0644)
+}
+
+// leaveCgroup removes the cgroup of a tap once its ss-server is gone
+func leaveCgroup(index int) {
+	if !bDryrun {
+		os.Remove(filepath.Join(cgroupRoot, serverCgroup(index)))
+	}
+}
+
+// aclChain is the chain holding the rules of a tap
+func aclChain(index int) string {
+	return "trr-" + tapNames[index]
+}
+
+// runTool runs a tool such as iptables or tc, only printing the command when
+// dry running.
+func runTool(bin string, arg ...string) error {
+	if bVerbose || bDryrun {
+		fmt.Println(bin + " " + strings.Join(arg, " "))
+	}
+	if bDryrun {
+		return nil
+	}
+	out, err := exec.Command(bin, arg...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v %s", bin, strings.Join(arg, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// applyACL sets the rules of the allocation on its tap, in a chain of its own
+// jumped to from FORWARD for the traffic coming in on the tap and from OUTPUT
+// for the traffic of its ss-server. Denied packets are logged with the
+// allocation name before they are dropped.
+func applyACL(index int, name string, acl *ACL) error {
+	chain := aclChain(index)
+	tap := tapNames[index]
+	aclApplied[index] = true
+	if err := joinCgroup(index); err != nil {
+		return fmt.Errorf("cgroup of %s: %v", tap, err)
+	}
+	// the log prefix of iptables is at most 29 characters
+	prefix := "trr deny " + name
+	if len(prefix) > 27 {
+		prefix = prefix[:27]
+	}
+	prefix += ": "
+
+	for _, bin := range []string{*iptables, *ip6tables} {
+		if bin == "" {
+			continue
+		}
+		removeChain(bin, chain, tap, serverCgroup(index))
+		if err := runTool(bin, "-N", chain); err != nil {
+			return err
+		}
+		for _, rule := range aclRules(chain, acl, bin == *iptables) {
+			if err := runTool(bin, rule...); err != nil {
+				return err
+			}
+		}
+		if err := runTool(bin, "-A", chain, "-m", "limit", "--limit", "10/min", "-j", "LOG", "--log-prefix", prefix); err != nil {
+			return err
+		}
+		if err := runTool(bin, "-A", chain, "-j", "DROP"); err != nil {
+			return err
+		}
+		// jumped to once the chain is complete, so nothing passes before
+		if err := runTool(bin, "-I", "FORWARD", "-i", tap, "-j", chain); err != nil {
+			return err
+		}
+		if err := runTool(bin, "-I", "OUTPUT", "-m", "cgroup", "--path", serverCgroup(index), "-j", chain); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("acl of %s applied on %s\n", name, tap)
+	return nil
+}
+
+// removeACL takes the rules of a tap away again
+func removeACL(index int) {
+	if !aclApplied[index] {
+		return
+	}
+	aclApplied[index] = false
+	for _, bin := range []string{*iptables, *ip6tables} {
+		if bin != "" {
+			removeChain(bin, aclChain(index), tapNames[index], serverCgroup(index))
+		}
+	}
+}
+
+func removeChain(bin string, chain string, tap string, cgroup string) {
+	if bDryrun {
+		return
+	}
+	exec.Command(bin, "-D", "FORWARD", "-i", tap, "-j", chain).Run()
+	exec.Command(bin, "-D", "OUTPUT", "-m", "cgroup", "--path", cgroup, "-j", chain).Run()
+	exec.Command(bin, "-F", chain).Run()
+	exec.Command(bin, "-X", chain).Run()
+}
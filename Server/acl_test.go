@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		allow string
+		want  []string
+		ok    bool
+	}{
+		{"", nil, true},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, true},
+		{"10.1.2.3", []string{"10.1.2.3/32"}, true},
+		{"192.168.1.0/24:22,80,8000-8100", []string{"192.168.1.0/24:22,80,8000-8100"}, true},
+		{"[fd00::/64]:443 [fd00::1]", []string{"fd00::/64:443", "fd00::1/128"}, true},
+		{"10.0.0.0/8  172.16.0.0/12:53", []string{"10.0.0.0/8", "172.16.0.0/12:53"}, true},
+		{"10.0.0.0/33", nil, false},
+		{"example.com", nil, false},
+		{"[fd00::/64:443", nil, false},
+		{"10.0.0.0/8:0", nil, false},
+		{"10.0.0.0/8:65536", nil, false},
+		{"10.0.0.0/8:100-80", nil, false},
+		{"10.0.0.0/8:http", nil, false},
+		{"10.0.0.0/8:22,", nil, false},
+	}
+	for _, test := range tests {
+		acl, err := parseACL(test.allow)
+		if (err == nil) != test.ok {
+			t.Errorf("parseACL(%q) error = %v", test.allow, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		var got []string
+		for _, rule := range acl.Rules {
+			s := rule.Net.String()
+			if len(rule.Ports) > 0 {
+				s += ":" + strings.Join(rule.Ports, ",")
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseACL(%q) = %v, want %v", test.allow, got, test.want)
+		}
+	}
+}
+
+func TestACLOf(t *testing.T) {
+	str := func(s string) *string { return &s }
+	acls := map[string]*string{
+		"alice":   str("10.0.0.1"),
+		"admins":  str("10.0.0.0/8:22"),
+		"default": str("192.168.1.0/24"),
+	}
+	groups := map[string]*string{"admins": str("alice bob")}
+	tests := []struct {
+		name  string
+		acls  map[string]*string
+		rules int
+		ok    bool
+	}{
+		{"alice_0", acls, 2, true},
+		{"bob_1", acls, 1, true},
+		{"carol_0", acls, 1, true},
+		{"carol_0", map[string]*string{"alice": str("10.0.0.1")}, 0, true},
+		{"alice_0", map[string]*string{"alice": str("10.0.0.0/99")}, 0, false},
+		{"carol_0", map[string]*string{"default": str("bad")}, 0, false},
+	}
+	for _, test := range tests {
+		acl, err := aclOf(test.name, test.acls, groups)
+		if (err == nil) != test.ok {
+			t.Errorf("aclOf(%s) error = %v", test.name, err)
+			continue
+		}
+		if test.ok && len(acl.Rules) != test.rules {
+			t.Errorf("aclOf(%s) has %d rules, want %d", test.name, len(acl.Rules), test.rules)
+		}
+	}
+	if acl, err := aclOf("alice_0", nil, groups); acl != nil || err != nil {
+		t.Errorf("aclOf without ACLs = %v, %v, want unrestricted", acl, err)
+	}
+	if err := validateACLs(map[string]*string{"ok": str("10.0.0.0/8"), "bad": str("10.0.0.0/8:x")}); err == nil || !strings.Contains(err.Error(), "acl.bad.allow") {
+		t.Errorf("validateACLs = %v, want the error of acl.bad", err)
+	}
+}
+
+func TestMultiportGroups(t *testing.T) {
+	ports := func(n int, format string) []string {
+		var p []string
+		for i := 0; i < n; i++ {
+			p = append(p, strings.Replace(format, "N", string(rune('a'+i)), -1))
+		}
+		return p
+	}
+	tests := []struct {
+		name  string
+		ports []string
+		sizes []int
+	}{
+		{"one", []string{"22"}, []int{1}},
+		{"range", []string{"8000-8100"}, []int{1}},
+		{"fifteen", ports(15, "N"), []int{15}},
+		{"sixteen", ports(16, "N"), []int{15, 1}},
+		{"ranges count twice", ports(8, "N-N"), []int{7, 1}},
+		{"mixed", append(ports(14, "N"), "1-2", "3"), []int{14, 2}},
+	}
+	for _, test := range tests {
+		var sizes []int
+		for _, group := range multiportGroups(test.ports) {
+			if strings.Contains(group, "-") {
+				t.Errorf("%s: %q keeps the - of a range", test.name, group)
+			}
+			sizes = append(sizes, len(strings.Split(group, ",")))
+		}
+		if !reflect.DeepEqual(sizes, test.sizes) {
+			t.Errorf("%s: groups of %v, want %v", test.name, sizes, test.sizes)
+		}
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	acl, err := parseACL("10.0.0.0/8 192.168.1.0/24:22,8000-8100 [fd00::/64]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ipv4 bool
+		want []string
+	}{
+		{true, []string{
+			"-A trr-tap0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			"-A trr-tap0 -d 10.0.0.0/8 -j ACCEPT",
+			"-A trr-tap0 -d 192.168.1.0/24 -p tcp -m multiport --dports 22,8000:8100 -j ACCEPT",
+			"-A trr-tap0 -d 192.168.1.0/24 -p udp -m multiport --dports 22,8000:8100 -j ACCEPT",
+		}},
+		{false, []string{
+			"-A trr-tap0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			"-A trr-tap0 -d fd00::/64 -p tcp -m multiport --dports 443 -j ACCEPT",
+			"-A trr-tap0 -d fd00::/64 -p udp -m multiport --dports 443 -j ACCEPT",
+		}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, rule := range aclRules("trr-tap0", acl, test.ipv4) {
+			got = append(got, strings.Join(rule, " "))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("aclRules(ipv4 %v) =\n%s\nwant\n%s", test.ipv4, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
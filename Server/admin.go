@@ -0,0 +1,227 @@
+/*
+Tunneling Recursive Router
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The admin API is served under /admin/ on the listen address, for requests
+// carrying "Authorization: Bearer <admintoken>". It is disabled while
+// admintoken is not set.
+//
+//   /admin/list               allocations with daemon PIDs and uptimes
+//   /admin/release/<name>     force the release of an allocation
+//   /admin/drain/on|off       refuse new allocations, or take them again
+//   /admin/reload             read the config file again
+//   /admin/reset/<signum>     reset the monthly usage of a signum
+//   /admin/dump               the internal state
+var bDraining bool
+var startTime [256]time.Time
+
+// AdminAllocation is an allocation as listed by the admin API
+type AdminAllocation struct {
+	Index      int
+	Name       string
+	Tap        string
+	Ip         string
+	Ip6        string `json:",omitempty"`
+	Port       int
+	ServerPort int
+	Pid        int `json:",omitempty"`
+	ServerPid  int `json:",omitempty"`
+	Uptime     int64
+	Bytes      int64
+	Usage      int64
+}
+
+func adminAuthorized(r *http.Request) bool {
+	if *admintoken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*admintoken)) == 1
+}
+
+
+func allocation(i int) AdminAllocation {
+	a := AdminAllocation{Index: i, Name: allocNames[i], Tap: tapNames[i], Ip: ipAddr[i], Ip6: ip6Addr[i], Port: port2tap[i], ServerPort: port2server[i]}
+	if cmds[i] != nil && cmds[i].Process != nil {
+		a.Pid = cmds[i].Process.Pid
+	}
+	if cmdsServer[i] != nil && cmdsServer[i].Process != nil {
+		a.ServerPid = cmdsServer[i].Process.Pid
+	}
+	if a.Name != "" {
+		a.Uptime = int64(time.Since(startTime[i]) / time.Second)
+	}
+	usageLock.Lock()
+	a.Bytes, a.Usage = tapBytes[i], usage[signum(a.Name)]
+	usageLock.Unlock()
+	return a
+}
+
+func adminReply(w http.ResponseWriter, v interface{}) {
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+func adminFail(w http.ResponseWriter, reason string) {
+	adminReply(w, map[string]string{"Status": "FAIL", "Reason": reason})
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		adminFail(w, "Unauthorized")
+		return
+	}
+	path := strings.SplitN(r.URL.Path[len("/admin/"):], "/", 2)
+	arg := ""
+	if len(path) == 2 {
+		arg = path[1]
+	}
+	fmt.Printf("admin %s %s\n", path[0], arg)
+
+	switch path[0] {
+	case "list":
+		allocLock.Lock()
+		defer allocLock.Unlock()
+		var list []AdminAllocation
+		for i, name := range allocNames {
+			if name != "" {
+				list = append(list, allocation(i))
+			}
+		}
+		adminReply(w, map[string]interface{}{"Status": "OK", "Draining": bDraining, "Allocations": list})
+	case "release":
+		allocLock.Lock()
+		defer allocLock.Unlock()
+		for i, name := range allocNames {
+			if name != "" && name == arg {
+				release(i)
+				adminReply(w, map[string]string{"Status": "OK"})
+				return
+			}
+		}
+		adminFail(w, "Not found")
+	case "drain":
+		allocLock.Lock()
+		defer allocLock.Unlock()
+		switch arg {
+		case "", "on":
+			bDraining = true
+		case "off":
+			bDraining = false
+		default:
+			adminFail(w, "Bad argument")
+			return
+		}
+		sdStatus()
+		adminReply(w, map[string]interface{}{"Status": "OK", "Draining": bDraining})
+	case "reload":
+		changes, err := reloadConfig()
+		if err != nil {
+			adminFail(w, err.Error())
+			return
+		}
+		adminReply(w, map[string]interface{}{"Status": "OK", "Changes": changes})
+	case "reset":
+		if arg == "" {
+			adminFail(w, "Bad argument")
+			return
+		}
+		allocLock.Lock()
+		defer allocLock.Unlock()
+		resetUsage(arg)
+		adminReply(w, map[string]string{"Status": "OK"})
+	case "dump":
+		allocLock.Lock()
+		defer allocLock.Unlock()
+		var slots []AdminAllocation
+		for i := 0; i < *numtap && i < maxTap; i++ {
+			slots = append(slots, allocation(i))
+		}
+		usageLock.Lock()
+		used := map[string]int64{}
+		for user, n := range usage {
+			used[user] = n
+		}
+		month := usageMonth
+		usageLock.Unlock()
+		adminReply(w, map[string]interface{}{"Status": "OK", "Config": cfgFile, "Draining": bDraining,
+			"Numtap": *numtap, "Slots": slots, "Month": month, "Usage": used,
+			"ACLs": len(aclAllow), "Limits": len(limitOptionMap)})
+	default:
+		adminFail(w, "Unknown command")
+	}
+}
+
+// adminCommand is the admin command line, sending a command of the admin API
+// to the Server of the config file and printing the reply.
+func adminCommand(command string, args []string) int {
+	commands := map[string]int{"list": 0, "release": 1, "drain": 1, "reload": 0, "reset": 1, "dump": 0}
+	n, ok := commands[command]
+	if !ok || len(args) > n || command != "drain" && len(args) < n {
+		fmt.Fprintf(os.Stderr, "admin commands: list, release <name>, drain [on|off], reload, reset <signum>, dump\n")
+		return 2
+	}
+	if *admintoken == "" {
+		fmt.Fprintf(os.Stderr, "admintoken is not set in %s\n", cfgFile)
+		return 1
+	}
+	client, url, err := adminClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req, err := http.NewRequest("GET", url+"/admin/"+strings.Join(append([]string{command}, args...), "/"), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*admintoken)
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	fmt.Print(string(body))
+
+	var reply struct{ Status string }
+	if json.Unmarshal(body, &reply) != nil || reply.Status != "OK" {
+		return 1
+	}
+	return 0
+}
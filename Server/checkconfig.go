@@ -0,0 +1,291 @@
+/*
+Tunneling Recursive Router
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configProblem is a problem of an option of the config file. Warnings are
+// reported but do not keep the config from being used. Advisory problems are
+// those of the host rather than of the file, a binary missing or a name not
+// resolving yet, which only -check-config fails on.
+type configProblem struct {
+	option   string
+	problem  string
+	warning  bool
+	advisory bool
+}
+
+// problems checks the types and ranges of the options, the overlaps of the
+// port ranges, the network values and that the binaries run are there.
+func (c *newConfig) problems() []configProblem {
+	var problems []configProblem
+	add := func(option string, warning bool, format string, a ...interface{}) {
+		problems = append(problems, configProblem{option, fmt.Sprintf(format, a...), warning, false})
+	}
+	advise := func(option string, format string, a ...interface{}) {
+		problems = append(problems, configProblem{option, fmt.Sprintf(format, a...), false, true})
+	}
+	port := func(option string) int {
+		n, err := strconv.Atoi(*c.strings[option])
+		if err != nil || n < 1 || n > 65535 {
+			add(option, false, "%q is not a port", *c.strings[option])
+			return 0
+		}
+		return n
+	}
+
+	numtap := *c.ints["numtap"]
+	if numtap < 1 || numtap > maxTap {
+		add("numtap", false, "%d is not between 1 and %d", numtap, maxTap)
+		numtap = 1
+	}
+	if *c.ints["starttap"] < 0 {
+		add("starttap", false, "%d is negative", *c.ints["starttap"])
+	}
+	startport := *c.ints["startport"]
+	if startport < 1 || startport+numtap-1 > 65535 {
+		add("startport", false, "ports %d to %d are not all ports", startport, startport+numtap-1)
+	}
+	lastport := startport + numtap - 1
+
+	if *c.ints["stepip"] < 1 {
+		add("stepip", false, "%d is not positive", *c.ints["stepip"])
+	}
+	if ip := net.ParseIP(*c.strings["startip"]); ip == nil || ip.To4() == nil {
+		add("startip", false, "%q is not an IPv4 address", *c.strings["startip"])
+	} else if ip = ip.To4(); int(ip[3])+(numtap-1)*(*c.ints["stepip"]) > 255 {
+		add("startip", false, "the addresses of %d taps run past %d.%d.%d.255", numtap, ip[0], ip[1], ip[2])
+	}
+	if s := *c.strings["startip6"]; s != "" {
+		if ip := net.ParseIP(s); ip == nil || ip.To4() != nil {
+			add("startip6", false, "%q is not an IPv6 address", s)
+		}
+		if *c.ints["stepip6"] < 1 {
+			add("stepip6", false, "%d is not positive", *c.ints["stepip6"])
+		}
+	}
+
+	// ss-server binds to listenhost too
+	if host := *c.strings["listenhost"]; net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			advise("listenhost", "%v", err)
+		}
+	}
+	listenOption := "listen"
+	if strings.TrimSpace(*c.strings["listen"]) == "" {
+		listenOption = "listenport"
+		port("listenport")
+	}
+	addresses, err := listenAddresses(*c.strings["listen"], *c.strings["listenhost"], *c.strings["listenport"])
+	if err != nil {
+		add(listenOption, false, "%v", err)
+	}
+	var listenPorts []int
+	for _, a := range addresses {
+		if a.network == "unix" {
+			continue
+		}
+		host, p, _ := net.SplitHostPort(a.address)
+		if host != "" && net.ParseIP(host) == nil && listenOption == "listen" {
+			if _, err := net.LookupHost(host); err != nil {
+				advise(listenOption, "%v", err)
+			}
+		}
+		n, _ := strconv.Atoi(p)
+		if n >= startport && n <= lastport {
+			add(listenOption, false, "%d is one of the tap ports %d to %d", n, startport, lastport)
+		}
+		listenPorts = append(listenPorts, n)
+	}
+	if _, err := parseListenMode(*c.strings["listenmode"]); err != nil {
+		add("listenmode", false, "%v", err)
+	}
+	first, last := port("serverstartport"), port("serverendport")
+	if first > 0 && last > 0 {
+		if first > last {
+			add("serverstartport", false, "%d is after serverendport %d", first, last)
+		}
+		if startport <= last && lastport >= first {
+			add("startport", true, "tap ports %d to %d overlap the ss-server ports %d to %d", startport, lastport, first, last)
+		}
+		for _, n := range listenPorts {
+			if n >= first && n <= last {
+				add(listenOption, true, "%d is in the ss-server ports %d to %d", n, first, last)
+			}
+		}
+	}
+
+	rated := *c.ints["ratelimit"] > 0
+	for _, option := range []string{"ratelimit", "quota"} {
+		if *c.ints[option] < 0 {
+			add(option, false, "%d is negative", *c.ints[option])
+		}
+	}
+	for name, limit := range c.limits {
+		if *limit.rate < -1 {
+			add("limit."+name+".rate", false, "%d is negative", *limit.rate)
+		}
+		if *limit.quota < -1 {
+			add("limit."+name+".quota", false, "%d is negative", *limit.quota)
+		}
+		rated = rated || *limit.rate > 0
+	}
+	for name, allow := range c.acls {
+		if _, err := parseACL(*allow); err != nil {
+			add("acl."+name+".allow", false, "%v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); len(c.acls) > 0 && err != nil {
+		add("acl", true, "no cgroup v2 hierarchy at %s, allocations fail as ss-server cannot be held to the ACLs", cgroupRoot)
+	}
+	for name, members := range c.groups {
+		if len(strings.Fields(*members)) == 0 {
+			add("group."+name+".members", true, "the group has no members")
+		}
+	}
+
+	binaries := []string{"tapdaemon", "serverdaemon"}
+	if len(c.acls) > 0 {
+		binaries = append(binaries, "iptables")
+		if *c.strings["ip6tables"] != "" {
+			binaries = append(binaries, "ip6tables")
+		}
+	}
+	if rated {
+		binaries = append(binaries, "tc")
+	}
+	for _, option := range binaries {
+		if _, err := exec.LookPath(*c.strings[option]); err != nil {
+			advise(option, "%v", err)
+		}
+	}
+	return problems
+}
+
+// optionLine returns the line of the config file setting the option, 0 if
+// it is not set there.
+func optionLine(lines []string, option string) int {
+	section := ""
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			if end := strings.Index(line, "]"); end > 0 {
+				section = strings.TrimSpace(line[1:end]) + "."
+			}
+			continue
+		}
+		if eq := strings.Index(line, "="); eq > 0 && section+strings.TrimSpace(line[:eq]) == option {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// errorPosition is the position of a parse error, at the line of the option
+// it names if there is one.
+func errorPosition(path string, lines []string, err error) string {
+	option := ""
+	for name := range stringDefaults {
+		if strings.Contains(err.Error(), name) && len(name) > len(option) {
+			option = name
+		}
+	}
+	for name := range intDefaults {
+		if strings.Contains(err.Error(), name) && len(name) > len(option) {
+			option = name
+		}
+	}
+	if line := optionLine(lines, option); option != "" && line > 0 {
+		return fmt.Sprintf("%s:%d", path, line)
+	}
+	return path
+}
+
+func readConfigLines(path string) []string {
+	var lines []string
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// optionPosition is where the config file sets an option, path:line or only
+// the path.
+func optionPosition(path string, lines []string, option string) string {
+	if line := optionLine(lines, option); line > 0 {
+		return fmt.Sprintf("%s:%d", path, line)
+	}
+	return path
+}
+
+// configError reports a bad value of an option as reportConfig does and
+// exits.
+func configError(path string, option string, format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: error: %s: %s\n", optionPosition(path, readConfigLines(path), option), option, fmt.Sprintf(format, a...))
+	os.Exit(1)
+}
+
+// reportConfig prints the problems of the config file as path:line: and
+// returns the number of errors among them. Advisory problems are errors
+// when strict, as for -check-config, and warnings otherwise.
+func reportConfig(path string, strict bool) int {
+	c, err := readConfig(path)
+	lines := readConfigLines(path)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "%s: error: %v\n", errorPosition(path, lines, err), err)
+		return 1
+	}
+	problems := c.problems()
+	sort.SliceStable(problems, func(i, j int) bool {
+		return optionLine(lines, problems[i].option) < optionLine(lines, problems[j].option)
+	})
+	errors := 0
+	for _, p := range problems {
+		kind := "error"
+		if p.warning || p.advisory && !strict {
+			kind = "warning"
+		} else {
+			errors++
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s: %s: %s\n", optionPosition(path, lines, p.option), kind, p.option, p.problem)
+	}
+	return errors
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReportConfig(t *testing.T) {
+	recordDefaults()
+	base := "tapdaemon=\"sh\"\nserverdaemon=\"sh\"\nlistenhost=\"127.0.0.1\"\n"
+	tests := []struct {
+		name   string
+		config string
+		errors int
+		strict int
+	}{
+		{"good", base, 0, 0},
+		{"missing binary", "tapdaemon=\"/nonexistent/tapdaemon\"\nserverdaemon=\"sh\"\nlistenhost=\"127.0.0.1\"\n", 0, 1},
+		{"unresolved listenhost", "tapdaemon=\"sh\"\nserverdaemon=\"sh\"\nlistenhost=\"trr.invalid\"\n", 0, 1},
+		{"bad startip", base + "startip=\"10.0.1\"\n", 1, 1},
+		{"bad startip6", base + "startip6=\"10.0.0.1\"\n", 1, 1},
+		{"bad acl", base + "iptables=\"sh\"\nip6tables=\"\"\n[acl.alice]\nallow=\"10.0.0.0/8:x\"\n", 1, 1},
+		{"parse error", base + "numtap=\"two\"\n", 1, 1},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "trr.cfg")
+		if err := os.WriteFile(path, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if errors := reportConfig(path, false); errors != test.errors {
+			t.Errorf("%s: %d errors at start, want %d", test.name, errors, test.errors)
+		}
+		if errors := reportConfig(path, true); errors != test.strict {
+			t.Errorf("%s: %d errors with -check-config, want %d", test.name, errors, test.strict)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+/*
+Tunneling Recursive Router
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the traffic through the taps. The rate is in kbit/s for each
+// allocation and direction, enforced with tc on its tap and with a hashlimit
+// of iptables on the port of its ss-server, and the quota in MiB a month for
+// each signum, counted over all its allocations, both ways in. When the
+// quota is used up the allocations of the signum are released and new ones
+// refused until the next month or until the usage is reset. Sections
+//
+//   [limit.<signum>]
+//   rate=10000
+//   quota=0
+//
+// override the defaults for a signum, 0 meaning no limit.
+type limitOptions struct {
+	rate  *int
+	quota *int
+}
+
+var limitOptionMap = map[string]*limitOptions{}
+
+var limitSectionRe = regexp.MustCompile(`^\s*\[limit\.([A-Za-z0-9_.-]+)\]`)
+
+// accountInterval is how often the byte counters of the taps are read
+const accountInterval = 10 * time.Second
+
+var usageLock sync.Mutex
+var usageMonth string
+var usage = map[string]int64{}
+var tapBytes [256]int64
+var lastBytes [256]int64
+var lastServerBytes [256]int64
+
+// serverLimited tells which taps have the chain of their ss-server port
+var serverLimited [256]bool
+
+// declareLimits declares the options of the [limit.*] sections of the config
+// file in set before it is parsed.
+func declareLimits(set optionSet, path string) map[string]*limitOptions {
+	limits := map[string]*limitOptions{}
+	file, err := os.Open(path)
+	if err != nil {
+		return limits
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		result := limitSectionRe.FindStringSubmatch(scanner.Text())
+		if result == nil || limits[result[1]] != nil {
+			continue
+		}
+		prefix := "limit." + result[1] + "."
+		limits[result[1]] = &limitOptions{set.Int(prefix+"rate", -1), set.Int(prefix+"quota", -1)}
+	}
+	return limits
+}
+
+// signum is the user part of an allocation name <signum>_<instance>
+func signum(name string) string {
+	if i := strings.LastIndex(name, "_"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// limitsFor returns the rate in kbit/s and the quota in bytes of a signum
+func limitsFor(user string) (int, int64) {
+	rate, quota := *ratelimit, *monthquota
+	if opt, ok := limitOptionMap[user]; ok {
+		if *opt.rate >= 0 {
+			rate = *opt.rate
+		}
+		if *opt.quota >= 0 {
+			quota = *opt.quota
+		}
+	}
+	return rate, int64(quota) << 20
+}
+
+func thisMonth() string {
+	return time.Now().Format("2006-01")
+}
+
+// loadUsage reads the usage of this month saved in usagefile
+func loadUsage() {
+	usageMonth = thisMonth()
+	if *usagefile == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(*usagefile)
+	if err != nil {
+		return
+	}
+	var saved struct {
+		Month string
+		Usage map[string]int64
+	}
+	if json.Unmarshal(b, &saved) == nil && saved.Month == usageMonth && saved.Usage != nil {
+		usage = saved.Usage
+	}
+}
+
+// saveUsage writes the usage to usagefile, called with usageLock held
+func saveUsage() {
+	if *usagefile == "" {
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{"Month": usageMonth, "Usage": usage})
+	if err := ioutil.WriteFile(*usagefile+".tmp", b, 0600); err == nil {
+		os.Rename(*usagefile+".tmp", *usagefile)
+	}
+}
+
+// overQuota tells whether a signum has used up its quota
+func overQuota(user string) bool {
+	_, quota := limitsFor(user)
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	return quota > 0 && usage[user] >= quota
+}
+
+// resetUsage clears the usage of a signum
+func resetUsage(user string) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	delete(usage, user)
+	saveUsage()
+}
+
+// readTapBytes returns the bytes sent and received on a tap
+func readTapBytes(tap string) (int64, error) {
+	var total int64
+	for _, counter := range []string{"rx_bytes", "tx_bytes"} {
+		b, err := ioutil.ReadFile("/sys/class/net/" + tap + "/statistics/" + counter)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// startAccounting counts the bytes of the allocated taps into the usage of
+// their signums and releases the allocations over quota.
+func startAccounting() {
+	loadUsage()
+	go func() {
+		for range time.Tick(accountInterval) {
+			account()
+		}
+	}()
+}
+
+func account() {
+	var over []int
+	allocLock.Lock()
+	defer allocLock.Unlock()
+	usageLock.Lock()
+	if month := thisMonth(); month != usageMonth {
+		usageMonth = month
+		usage = map[string]int64{}
+	}
+	for i, name := range allocNames {
+		if name == "" {
+			continue
+		}
+		n, err := readTapBytes(tapNames[i])
+		if err != nil {
+			continue
+		}
+		delta := n - lastBytes[i]
+		if delta < 0 {
+			// the tap was created again
+			delta = n
+		}
+		lastBytes[i] = n
+		if n, err := readServerBytes(i); err == nil {
+			if n >= lastServerBytes[i] {
+				delta += n - lastServerBytes[i]
+			}
+			lastServerBytes[i] = n
+		}
+		tapBytes[i] += delta
+		user := signum(name)
+		usage[user] += delta
+		if _, quota := limitsFor(user); quota > 0 && usage[user] >= quota {
+			over = append(over, i)
+		}
+	}
+	saveUsage()
+	usageLock.Unlock()
+
+	for _, i := range over {
+		fmt.Printf("quota of %s used up, releasing %s\n", signum(allocNames[i]), allocNames[i])
+		release(i)
+	}
+}
+
+// startAllocationUsage starts counting the bytes of a new allocation
+func startAllocationUsage(index int) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	tapBytes[index] = 0
+	lastBytes[index], _ = readTapBytes(tapNames[index])
+	lastServerBytes[index] = 0
+}
+
+// applyRate limits the traffic of a tap in both directions once tapdaemon
+// has created it, with a token bucket filter for what is sent to the tap and
+// a policer for what is received.
+func applyRate(index int, rate int) {
+	if rate <= 0 {
+		return
+	}
+	tap := tapNames[index]
+	for i := 0; i < 50 && !bDryrun; i++ {
+		if _, err := os.Stat("/sys/class/net/" + tap); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	kbit := fmt.Sprintf("%dkbit", rate)
+	// a burst of 1/8 s, at least a few frames
+	burst := fmt.Sprintf("%dkbit", rate/8+64)
+	for _, arg := range [][]string{
+		{"qdisc", "replace", "dev", tap, "root", "tbf", "rate", kbit, "burst", burst, "latency", "400ms"},
+		{"qdisc", "replace", "dev", tap, "handle", "ffff:", "ingress"},
+		{"filter", "replace", "dev", tap, "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", kbit, "burst", burst, "drop"},
+	} {
+		if err := runTool(*tc, arg...); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
+
+// serverChain is the chain of the mangle table counting, and limiting, the
+// traffic on the ss-server port of a tap. The mangle table is passed before
+// the rules of the ACLs, which accept the packets they let through.
+func serverChain(index int) string {
+	return "trr-" + tapNames[index] + "-ss"
+}
+
+// serverRules returns the rules of the chain of an ss-server port. Over the
+// rate, in kbit/s as for the tap, packets are dropped by a hashlimit for each
+// direction. The RETURN at the end counts the bytes let through.
+func serverRules(chain string, index int, port int, rate int) [][]string {
+	var rules [][]string
+	if rate > 0 {
+		bytes := fmt.Sprintf("%db/s", rate*1000/8)
+		burst := fmt.Sprintf("%dkb", rate/64+64)
+		for _, proto := range []string{"tcp", "udp"} {
+			for _, dir := range []struct{ match, name string }{{"--dport", "in"}, {"--sport", "out"}} {
+				rules = append(rules, []string{"-A", chain, "-p", proto, dir.match, fmt.Sprint(port),
+					"-m", "hashlimit", "--hashlimit-above", bytes, "--hashlimit-burst", burst,
+					"--hashlimit-name", fmt.Sprintf("trr-%s-%d", dir.name, index), "-j", "DROP"})
+			}
+		}
+	}
+	return append(rules, []string{"-A", chain, "-j", "RETURN"})
+}
+
+// serverJumps are the rules sending the traffic of an ss-server port to its
+// chain, for inserting and deleting
+func serverJumps(chain string, port int) [][]string {
+	var jumps [][]string
+	for _, proto := range []string{"tcp", "udp"} {
+		jumps = append(jumps,
+			[]string{"INPUT", "-p", proto, "--dport", fmt.Sprint(port), "-j", chain},
+			[]string{"OUTPUT", "-p", proto, "--sport", fmt.Sprint(port), "-j", chain})
+	}
+	return jumps
+}
+
+// applyServerLimit counts and limits the traffic on the ss-server port of a
+// tap once ss-server has told its port.
+func applyServerLimit(index int, rate int) error {
+	port := port2server[index]
+	if port <= 0 {
+		return fmt.Errorf("no ss-server port for %s", tapNames[index])
+	}
+	removeServerLimit(index)
+	chain := serverChain(index)
+	serverLimited[index] = true
+	for _, bin := range []string{*iptables, *ip6tables} {
+		if bin == "" {
+			continue
+		}
+		if err := runTool(bin, "-t", "mangle", "-N", chain); err != nil {
+			return err
+		}
+		for _, rule := range serverRules(chain, index, port, rate) {
+			if err := runTool(bin, append([]string{"-t", "mangle"}, rule...)...); err != nil {
+				return err
+			}
+		}
+		for _, jump := range serverJumps(chain, port) {
+			if err := runTool(bin, append([]string{"-t", "mangle", "-I"}, jump...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeServerLimit takes the chain of an ss-server port away again
+func removeServerLimit(index int) {
+	if !serverLimited[index] {
+		return
+	}
+	serverLimited[index] = false
+	if bDryrun {
+		return
+	}
+	chain := serverChain(index)
+	for _, bin := range []string{*iptables, *ip6tables} {
+		if bin == "" {
+			continue
+		}
+		for _, jump := range serverJumps(chain, port2server[index]) {
+			exec.Command(bin, append([]string{"-t", "mangle", "-D"}, jump...)...).Run()
+		}
+		exec.Command(bin, "-t", "mangle", "-F", chain).Run()
+		exec.Command(bin, "-t", "mangle", "-X", chain).Run()
+	}
+}
+
+// readServerBytes returns the bytes let through the ss-server port of a tap
+func readServerBytes(index int) (int64, error) {
+	if !serverLimited[index] || bDryrun {
+		return 0, fmt.Errorf("%s not counted", tapNames[index])
+	}
+	var total int64
+	for _, bin := range []string{*iptables, *ip6tables} {
+		if bin == "" {
+			continue
+		}
+		out, err := exec.Command(bin, "-t", "mangle", "-nvxL", serverChain(index)).Output()
+		if err != nil {
+			return 0, err
+		}
+		total += chainBytes(string(out))
+	}
+	return total, nil
+}
+
+// chainBytes sums the byte counters of the RETURN rules in the listing of a
+// chain by iptables -nvxL
+func chainBytes(listing string) int64 {
+	var total int64
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != "RETURN" {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total
+}
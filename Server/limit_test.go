@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServerRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rate int
+		want []string
+	}{
+		{"counted only", 0, []string{"-A trr-tap3-ss -j RETURN"}},
+		{"limited", 8000, []string{
+			"-A trr-tap3-ss -p tcp --dport 10240 -m hashlimit --hashlimit-above 1000000b/s --hashlimit-burst 189kb --hashlimit-name trr-in-3 -j DROP",
+			"-A trr-tap3-ss -p tcp --sport 10240 -m hashlimit --hashlimit-above 1000000b/s --hashlimit-burst 189kb --hashlimit-name trr-out-3 -j DROP",
+			"-A trr-tap3-ss -p udp --dport 10240 -m hashlimit --hashlimit-above 1000000b/s --hashlimit-burst 189kb --hashlimit-name trr-in-3 -j DROP",
+			"-A trr-tap3-ss -p udp --sport 10240 -m hashlimit --hashlimit-above 1000000b/s --hashlimit-burst 189kb --hashlimit-name trr-out-3 -j DROP",
+			"-A trr-tap3-ss -j RETURN",
+		}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, rule := range serverRules("trr-tap3-ss", 3, 10240, test.rate) {
+			got = append(got, strings.Join(rule, " "))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: serverRules =\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+
+	// a hashlimit name is at most 15 characters
+	for _, rule := range serverRules("trr-tap255-ss", 255, 65535, 1) {
+		for i, arg := range rule {
+			if arg == "--hashlimit-name" && len(rule[i+1]) > 15 {
+				t.Errorf("hashlimit name %q too long", rule[i+1])
+			}
+		}
+	}
+}
+
+func TestChainBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing string
+		want    int64
+	}{
+		{"empty", "", 0},
+		{"counted", `Chain trr-tap0-ss (4 references)
+    pkts      bytes target     prot opt in     out     source               destination
+      12     3456 DROP       tcp  --  *      *       0.0.0.0/0            0.0.0.0/0            tcp dpt:10240 limit: above 1000000b/s burst 189kb
+    1000  1234567 RETURN     all  --  *      *       0.0.0.0/0            0.0.0.0/0
+`, 1234567},
+		{"two returns", "Chain x\n pkts bytes target\n 1 10 RETURN all\n 2 20 RETURN all\n", 30},
+		{"garbage", "Chain x\n pkts bytes target\n a b RETURN\n", 0},
+	}
+	for _, test := range tests {
+		if got := chainBytes(test.listing); got != test.want {
+			t.Errorf("%s: chainBytes = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Tunneling Recursive Router
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The Server listens on the addresses of the listen option, separated by
+// spaces or commas, each one host:port, [IPv6]:port or unix:<path>, e.g.
+//
+//   listen="127.0.0.1:18080 [::1]:18080 unix:/run/trr/control.sock"
+//   listenmode="0660"
+//
+// A Unix socket keeps the control API to the local users allowed by its
+// mode. Without listen the Server listens on listenhost:listenport.
+type listenAddress struct {
+	network string
+	address string
+}
+
+func (a listenAddress) String() string {
+	if a.network == "unix" {
+		return "unix:" + a.address
+	}
+	return a.address
+}
+
+// listenAddresses returns the addresses to listen on
+func listenAddresses(listen string, host string, port string) ([]listenAddress, error) {
+	if strings.TrimSpace(listen) == "" {
+		listen = net.JoinHostPort(host, port)
+	}
+	var addresses []listenAddress
+	for _, s := range strings.FieldsFunc(listen, func(r rune) bool { return r == ' ' || r == ',' }) {
+		a, err := parseListenAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, nil
+}
+
+func parseListenAddress(s string) (listenAddress, error) {
+	if strings.HasPrefix(s, "unix:") {
+		if len(s) == len("unix:") {
+			return listenAddress{}, fmt.Errorf("%s: no socket path", s)
+		}
+		return listenAddress{"unix", s[len("unix:"):]}, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return listenAddress{}, fmt.Errorf("%s: %v", s, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return listenAddress{}, fmt.Errorf("%s: bad port %s", s, port)
+	}
+	if strings.HasPrefix(s, "[") && (net.ParseIP(host) == nil || !strings.Contains(host, ":")) {
+		return listenAddress{}, fmt.Errorf("%s: bad IPv6 address %s", s, host)
+	}
+	return listenAddress{"tcp", s}, nil
+}
+
+// parseListenMode parses the octal mode of the Unix sockets
+func parseListenMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal file mode", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// openListeners binds every address, closing those already bound if one of
+// them fails.
+func openListeners(addresses []listenAddress, mode os.FileMode) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, a := range addresses {
+		l, err := listenOn(a, mode)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %v", a, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func listenOn(a listenAddress, mode os.FileMode) (net.Listener, error) {
+	if a.network != "unix" {
+		return net.Listen(a.network, a.address)
+	}
+	// a socket left by a Server that is gone is taken over, a live one not
+	if fi, err := os.Lstat(a.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", a.address); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("a Server is listening there")
+		}
+		os.Remove(a.address)
+	}
+	l, err := net.Listen("unix", a.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(a.address, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serve serves the web commands on every listener until one of them fails
+func serve(listeners []net.Listener) error {
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		fmt.Printf("listening on %s\n", l.Addr())
+		go func(l net.Listener) {
+			errc <- fmt.Errorf("serve %s: %v", l.Addr(), http.Serve(l, nil))
+		}(l)
+	}
+	return <-errc
+}
+
+// listenDisplay is the first listen address, as shown by the usage
+func listenDisplay() string {
+	addresses, err := listenAddresses(*listen, *listenhost, *listenport)
+	if err != nil || len(addresses) == 0 {
+		return net.JoinHostPort(*listenhost, *listenport)
+	}
+	return addresses[0].String()
+}
+
+// adminClient returns a client of the first listen address and the URL to
+// send the commands to.
+func adminClient() (*http.Client, string, error) {
+	addresses, err := listenAddresses(*listen, *listenhost, *listenport)
+	if err != nil {
+		return nil, "", err
+	}
+	a := addresses[0]
+	if a.network != "unix" {
+		return http.DefaultClient, "http://" + a.address, nil
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", a.address)
+		},
+	}
+	return &http.Client{Transport: transport}, "http://localhost", nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		in   string
+		want listenAddress
+		ok   bool
+	}{
+		{"127.0.0.1:18080", listenAddress{"tcp", "127.0.0.1:18080"}, true},
+		{"localhost:18080", listenAddress{"tcp", "localhost:18080"}, true},
+		{"[::1]:18080", listenAddress{"tcp", "[::1]:18080"}, true},
+		{":18080", listenAddress{"tcp", ":18080"}, true},
+		{"unix:/run/trr/control.sock", listenAddress{"unix", "/run/trr/control.sock"}, true},
+		{"unix:", listenAddress{}, false},
+		{"127.0.0.1", listenAddress{}, false},
+		{"127.0.0.1:http", listenAddress{}, false},
+		{"127.0.0.1:65536", listenAddress{}, false},
+		{"::1:18080", listenAddress{}, false},
+		{"[zz]:1", listenAddress{}, false},
+		{"[10.0.0.1]:1", listenAddress{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseListenAddress(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("parseListenAddress(%q) error = %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseListenAddress(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   []string
+		ok     bool
+	}{
+		{"", []string{"localhost:18080"}, true},
+		{"  ", []string{"localhost:18080"}, true},
+		{"127.0.0.1:1 [::1]:2,unix:/tmp/s", []string{"127.0.0.1:1", "[::1]:2", "unix:/tmp/s"}, true},
+		{"127.0.0.1:1 nonsense", nil, false},
+	}
+	for _, test := range tests {
+		addresses, err := listenAddresses(test.listen, "localhost", "18080")
+		if (err == nil) != test.ok {
+			t.Errorf("listenAddresses(%q) error = %v", test.listen, err)
+			continue
+		}
+		var got []string
+		for _, a := range addresses {
+			got = append(got, a.String())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("listenAddresses(%q) = %v, want %v", test.listen, got, test.want)
+		}
+	}
+}
+
+func TestParseListenMode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want os.FileMode
+		ok   bool
+	}{
+		{"0660", 0660, true},
+		{"600", 0600, true},
+		{"0777", 0777, true},
+		{"1777", 0, false},
+		{"0890", 0, false},
+		{"rw", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseListenMode(test.in)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseListenMode(%q) = %v, %v", test.in, got, err)
+		}
+	}
+}
+
+func TestListenOnUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	a := listenAddress{"unix", path}
+	l, err := listenOn(a, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, %v", fi.Mode(), err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	if _, err := listenOn(a, 0600); err == nil {
+		t.Errorf("took over the socket of a live listener")
+	}
+	l.Close()
+
+	// a socket left behind is taken over
+	stale, err := listenOn(a, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	stale.Close()
+	again, err := listenOn(a, 0660)
+	if err != nil {
+		t.Fatalf("stale socket not taken over: %v", err)
+	}
+	again.Close()
+}
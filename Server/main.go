@@ -37,6 +37,9 @@ import (
 	"strings"
 	"strconv"
 	"math/rand"
+	"net"
+	"time"
+	"sync"
 	config "github.com/stvp/go-toml-config"
 	sh "github.com/bjornrun/go-sh"
 )
@@ -48,12 +51,23 @@ var (
 	startport    		 = config.Int("startport", 50025)
 	startip     		 = config.String("startip", "10.0.1.136")
 	stepip           	 = config.Int("stepip", 4)
+	startip6     		 = config.String("startip6", "")
+	stepip6           	 = config.Int("stepip6", 4)
 	tapdaemon  			 = config.String("tapdaemon", "./tapdaemon")
 	listenhost  		 = config.String("listenhost", "localhost")
 	listenport  		 = config.String("listenport", "18080")
+	listen				 = config.String("listen", "")
+	listenmode			 = config.String("listenmode", "0660")
 	serverdaemon		 = config.String("serverdaemon", "ss-server")
 	serverstartport		 = config.String("serverstartport", "10240")
 	serverendport		 = config.String("serverendport", "65535")
+	iptables			 = config.String("iptables", "iptables")
+	ip6tables			 = config.String("ip6tables", "ip6tables")
+	ratelimit			 = config.Int("ratelimit", 0)
+	monthquota			 = config.Int("quota", 0)
+	usagefile			 = config.String("usagefile", "")
+	tc					 = config.String("tc", "tc")
+	admintoken			 = config.String("admintoken", "")
 )
 
 const maxTap=256
@@ -64,27 +78,57 @@ var cmdsServer  [256]*exec.Cmd
 var allocNames  [256]string
 var tapNames    [256]string
 var ipAddr      [256]string
+var ip6Addr     [256]string
 var port2tap    [256]int
 var port2server [256]int
 var password	[256]string
+// slotGeneration counts the releases of each slot
+var slotGeneration [256]int
+// allocLock guards the allocations, from their slots to their daemons
+var allocLock sync.Mutex
 var expression string
 var command string
 var logfile string
 var bQuiet bool
 var bVerbose bool
 var bDryrun bool
+var adminCmd string
+var bCheckConfig bool
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s\n", os.Args[0])
 	flag.PrintDefaults()
-	fmt.Fprintf(os.Stderr,"\nWeb commands:\nhttp://%s:%s/allocate/<signum>_<instance> - allocate a free port -> assigned IP address\n",*listenhost,*listenport)
-	fmt.Fprintf(os.Stderr,"http://%s:%s/remove/<signum>_<instance> - remove an allocated port\n",*listenhost,*listenport)
-	fmt.Fprintf(os.Stderr,"http://%s:%s/port/<signum>_<instance> Show port\n",*listenhost,*listenport)
-	fmt.Fprintf(os.Stderr,"http://%s:%s/ip/<signum>_<instance> Show IP address\n",*listenhost,*listenport)
-	fmt.Fprintf(os.Stderr,"http://%s:%s/list - list allocated ports\n",*listenhost,*listenport)
-	fmt.Fprintf(os.Stderr,"Example of tapmanager.cfg:\ntapname=\"tap\"\nnumtap=1\nstarttap=0\nstartip=\"10.1.1.4\"\nstepip=4\ntapdaemon=\"./tapdaemon\"\nlistenhost=\"127.0.0.1\"\nlistenport=\"18080\"\n")
+	fmt.Fprintf(os.Stderr,"\nWeb commands:\nhttp://%s/allocate/<signum>_<instance> - allocate a free port -> assigned IP address\n",listenDisplay())
+	fmt.Fprintf(os.Stderr,"http://%s/remove/<signum>_<instance> - remove an allocated port\n",listenDisplay())
+	fmt.Fprintf(os.Stderr,"http://%s/port/<signum>_<instance> Show port\n",listenDisplay())
+	fmt.Fprintf(os.Stderr,"http://%s/ip/<signum>_<instance> Show IP address\n",listenDisplay())
+	fmt.Fprintf(os.Stderr,"http://%s/list - list allocated ports\n",listenDisplay())
+	fmt.Fprintf(os.Stderr,"\nAdmin commands, with admintoken set in the config file:\n%s -admin list - list allocations with PIDs and uptimes\n",os.Args[0])
+	fmt.Fprintf(os.Stderr,"%s -admin release <signum>_<instance> - force the release of an allocation\n",os.Args[0])
+	fmt.Fprintf(os.Stderr,"%s -admin drain [on|off] - refuse new allocations, or take them again\n",os.Args[0])
+	fmt.Fprintf(os.Stderr,"%s -admin reload - read the config file again, as on SIGHUP\n",os.Args[0])
+	fmt.Fprintf(os.Stderr,"%s -admin reset <signum> - reset the monthly usage of a signum\n",os.Args[0])
+	fmt.Fprintf(os.Stderr,"%s -admin dump - dump the internal state\n",os.Args[0])
+	fmt.Fprintf(os.Stderr,"The same commands are served at http://%s/admin/<command>[/<argument>] with the header \"Authorization: Bearer <admintoken>\"\n",listenDisplay())
+	fmt.Fprintf(os.Stderr,"Example of tapmanager.cfg:\ntapname=\"tap\"\nnumtap=1\nstarttap=0\nstartip=\"10.1.1.4\"\nstepip=4\nstartip6=\"fd00:1:1::4\"\nstepip6=4\ntapdaemon=\"./tapdaemon\"\nlistenhost=\"127.0.0.1\"\nlistenport=\"18080\"\n")
+	fmt.Fprintf(os.Stderr,"Several listen addresses, IPv6 ones in brackets, and a Unix socket instead of listenhost and listenport:\nlisten=\"127.0.0.1:18080 [::1]:18080 unix:/run/trr/control.sock\"\nlistenmode=\"0660\"\n")
+	fmt.Fprintf(os.Stderr,"\nUnder systemd the Server notifies READY, RELOADING, STOPPING, STATUS and WATCHDOG with Type=notify and takes the listeners of a socket unit instead of the listen addresses.\n")
+	fmt.Fprintf(os.Stderr,"\nAccess control, each allocation <signum>_<instance> may only reach the destinations allowed to the signum and its groups, through the tap and through its ss-server, which needs cgroup v2:\n[group.admins]\nmembers=\"alice bob\"\n[acl.admins]\nallow=\"10.0.0.0/8 [fd00::/64]:22\"\n[acl.default]\nallow=\"192.168.1.0/24:80,443,8000-8100\"\n")
+	fmt.Fprintf(os.Stderr,"\nTraffic limits, the rate in kbit/s per allocation on its tap and its ss-server port and the quota in MiB per signum and month, 0 for none:\nratelimit=10000\nquota=0\nusagefile=\"trr-usage.json\"\n[limit.alice]\nrate=0\nquota=20480\n")
+}
+
+// addIP6 returns the IPv6 address n addresses after start
+func addIP6(start net.IP, n int) string {
+	ip := make(net.IP, len(start))
+	copy(ip, start)
+	for i := len(ip) - 1; i >= 0 && n > 0; i-- {
+		sum := int(ip[i]) + n
+		ip[i] = byte(sum & 0xff)
+		n = sum >> 8
+	}
+	return ip.String()
 }
 
 func randSeq(n int) string {
@@ -133,9 +177,16 @@ func readLoop(r *bufio.Reader, index int, w http.ResponseWriter) {
 
 			var serverport, _ = strconv.Atoi(cmd);
 
+			allocLock.Lock()
 			port2server[index] = serverport;
+			if rate, quota := limitsFor(signum(allocNames[index])); rate > 0 || quota > 0 {
+				if err := applyServerLimit(index, rate); err != nil {
+					fmt.Println(err)
+				}
+			}
 
-			fmt.Fprintf(w, "{\"Tap\":\"%s\", \"Ip\":\"%s\", \"Port\":%d, \"ServerPort\":%d, \"Password\":\"%s\", \"Status\":\"OK\"}\n", tapNames[index], ipAddr[index], port2tap[index], port2server[index], password[index])
+			fmt.Fprintf(w, "{\"Tap\":\"%s\", \"Ip\":\"%s\", \"Ip6\":\"%s\", \"Port\":%d, \"ServerPort\":%d, \"Password\":\"%s\", \"Status\":\"OK\"}\n", tapNames[index], ipAddr[index], ip6Addr[index], port2tap[index], port2server[index], password[index])
+			allocLock.Unlock()
 
 
 			if (!bDryrun) {
@@ -196,7 +247,11 @@ func readLoop(r *bufio.Reader, index int, w http.ResponseWriter) {
 	}
 }
 
-func execWatch(i int, cmd *exec.Cmd) {
+// execWatch waits for the tapdaemon of an allocation, the only place it is
+// waited for, and releases the allocation when it ends by itself. Once the
+// allocation was released the slot is left alone, as it may already hold
+// the next one.
+func execWatch(i int, generation int, cmd *exec.Cmd) {
 	donec := make(chan error, 1)
 	go func() {
 		donec <- cmd.Wait()
@@ -206,20 +261,25 @@ func execWatch(i int, cmd *exec.Cmd) {
 		//              cmd.Process.Kill()
 		//              fmt.Println("timeout")
 	case <-donec:
-		fmt.Println("done and removed")
-		allocNames[i] = ""
-		if (cmds[i] != nil) {
-			cmds[i] = nil
+		allocLock.Lock()
+		defer allocLock.Unlock()
+		if (slotGeneration[i] != generation || cmds[i] != cmd) {
+			return
 		}
+		fmt.Println("done and removed")
+		cmds[i] = nil
+		release(i)
 	}
 }
 
 func allocateHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Path[len("/allocate/"):]
 	fmt.Printf("alloc name = %s\n", name)
+	allocLock.Lock()
+	defer allocLock.Unlock()
 	for i, line := range allocNames {
 		if (line == name) {
-			fmt.Fprintf(w, "{\"Tap\":\"%s\", \"Ip\":\"%s\", \"Port\":%d, \"ServerPort\":%d, \"Status\":\"OK\"}\n", tapNames[i], ipAddr[i], port2tap[i], port2server[i])
+			fmt.Fprintf(w, "{\"Tap\":\"%s\", \"Ip\":\"%s\", \"Ip6\":\"%s\", \"Port\":%d, \"ServerPort\":%d, \"Status\":\"OK\"}\n", tapNames[i], ipAddr[i], ip6Addr[i], port2tap[i], port2server[i])
 			return
 		}
 	}
@@ -231,19 +291,56 @@ func allocateHandler(w http.ResponseWriter, r *http.Request) {
 			} else
 			{
 //				fmt.Fprintf(w, "{\"Tap\":\"%s\", \"Ip\":\"%s\", \"Port\":%d, \"ServerPort\":%d, \"Status\":\"OK\"}\n", tapNames[i], ipAddr[i], port2tap[i], port2server[i])
+				if bDraining {
+					fmt.Fprintf(w, "{\"Status\":\"FAIL\", \"Reason\":\"Draining\"}\n")
+					return
+				}
+				if overQuota(signum(name)) {
+					fmt.Fprintf(w, "{\"Status\":\"FAIL\", \"Reason\":\"Quota\"}\n")
+					return
+				}
+				acl, err := aclFor(name)
+				if err != nil {
+					fmt.Println(err)
+					fmt.Fprintf(w, "{\"Status\":\"FAIL\", \"Reason\":\"ACL\"}\n")
+					return
+				}
+				if acl != nil {
+					if err := applyACL(i, name, acl); err != nil {
+						fmt.Println(err)
+						removeACL(i)
+						leaveCgroup(i)
+						fmt.Fprintf(w, "{\"Status\":\"FAIL\", \"Reason\":\"ACL\"}\n")
+						return
+					}
+				}
 				allocNames[i] = name
+				startTime[i] = time.Now()
 				password[i] = randSeq(10)
 
 				cmdsServer[i] = exec.Command(*serverdaemon, "-s", *listenhost, "-k", password[i] ,"--port-start",*serverstartport,"--port-end",*serverendport)
 
 				Serverstderr, _ := cmdsServer[i].StderrPipe()
 				cmdsServer[i].Start()
+				// the connections of ss-server are held to the ACL too
+				if acl != nil {
+					if err := joinCgroup(i); err != nil {
+						fmt.Println(err)
+						release(i)
+						fmt.Fprintf(w, "{\"Status\":\"FAIL\", \"Reason\":\"ACL\"}\n")
+						return
+					}
+				}
 				r := bufio.NewReader(Serverstderr)
 				go readLoop( r, i, w)
 
+				startAllocationUsage(i)
 				cmds[i] = exec.Command(*tapdaemon, tapNames[i], fmt.Sprintf("%d", port2tap[i]))
 				cmds[i].Start()
-				go execWatch(i, cmds[i])
+				go execWatch(i, slotGeneration[i], cmds[i])
+				rate, _ := limitsFor(signum(name))
+				go applyRate(i, rate)
+				sdStatus()
 				return
 			}
 		}
@@ -254,17 +351,13 @@ func allocateHandler(w http.ResponseWriter, r *http.Request) {
 func removeHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Path[len("/remove/"):]
 	fmt.Printf("remove name = %s\n", name)
+	allocLock.Lock()
+	defer allocLock.Unlock()
 
 	for i, line := range allocNames {
 		if (line == name) {
 			fmt.Fprintf(w, "{\"Status\":\"OK\"}")
-			allocNames[i] = ""
-			fmt.Printf("removed\n")
-			if (cmds[i] != nil) {
-				cmds[i].Process.Kill()
-				cmds[i].Wait()
-				cmds[i] = nil
-			}
+			release(i)
 			return
 
 		}
@@ -273,9 +366,36 @@ func removeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "{\"Status\":\"FAIL\", \"Reason\":\"Not found\"}\n")
 }
 
+// release frees an allocation and stops its daemons, called with allocLock
+// held. The tapdaemon is waited for by its execWatch.
+func release(i int) {
+	slotGeneration[i]++
+	allocNames[i] = ""
+	removeACL(i)
+	fmt.Printf("removed\n")
+	if (cmds[i] != nil) {
+		if (cmds[i].Process != nil) {
+			cmds[i].Process.Kill()
+		}
+		cmds[i] = nil
+	}
+	if (cmdsServer[i] != nil) {
+		if (cmdsServer[i].Process != nil) {
+			cmdsServer[i].Process.Kill()
+		}
+		cmdsServer[i].Wait()
+		cmdsServer[i] = nil
+	}
+	leaveCgroup(i)
+	removeServerLimit(i)
+	sdStatus()
+}
+
 func portHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Path[len("/port/"):]
 	fmt.Printf("port name = %s\n", name)
+	allocLock.Lock()
+	defer allocLock.Unlock()
 	for i, line := range allocNames {
 		if (line == name) {
 			fmt.Fprintf(w, "{\"Port\":%d, \"Status\":\"OK\"}\n", port2tap[i])
@@ -288,9 +408,11 @@ func portHandler(w http.ResponseWriter, r *http.Request) {
 func ipHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Path[len("/ip/"):]
 	fmt.Printf("ip name = %s\n", name)
+	allocLock.Lock()
+	defer allocLock.Unlock()
 	for i, line := range allocNames {
 		if (line == name) {
-			fmt.Fprintf(w, "{\"Ip\":\"%s\",\"Status\":\"OK\"}\n", ipAddr[i])
+			fmt.Fprintf(w, "{\"Ip\":\"%s\", \"Ip6\":\"%s\", \"Status\":\"OK\"}\n", ipAddr[i], ip6Addr[i])
 			return
 		}
 	}
@@ -299,9 +421,15 @@ func ipHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func listHandler(w http.ResponseWriter, r *http.Request) {
+	allocLock.Lock()
+	defer allocLock.Unlock()
 	for i, line := range allocNames {
 		if (line != "") {
-			fmt.Fprintf(w, "{\"Name\":\"%s\", \"Tap\":\"%s\", \"Ip\":\"%s\", \"Port\":%d, \"Status\":\"OK\"}\n",line, tapNames[i], ipAddr[i], port2tap[i])
+			rate, quota := limitsFor(signum(line))
+			usageLock.Lock()
+			bytes, used := tapBytes[i], usage[signum(line)]
+			usageLock.Unlock()
+			fmt.Fprintf(w, "{\"Name\":\"%s\", \"Tap\":\"%s\", \"Ip\":\"%s\", \"Ip6\":\"%s\", \"Port\":%d, \"Rate\":%d, \"Bytes\":%d, \"Usage\":%d, \"Quota\":%d, \"Status\":\"OK\"}\n",line, tapNames[i], ipAddr[i], ip6Addr[i], port2tap[i], rate, bytes, used, quota)
 		}
 
 	}
@@ -317,12 +445,32 @@ func main() {
 
 	flag.StringVar(&cfgFile, "c", "trr.cfg", "Tunneling Recursive Router config setup file")
 	flag.BoolVar(&verbose,"v", false, "Verbose")
+	flag.BoolVar(&bCheckConfig,"check-config", false, "Check the config file, print its problems and exit")
+	flag.StringVar(&adminCmd,"admin", "", "Send an admin command to the running Server: list, release, drain, reload, reset or dump")
 
 	flag.Usage = Usage
 	flag.Parse()
 
+	recordDefaults()
+	// the admin command line only needs the address and the token. A start
+	// only stops on the errors of the file itself.
+	if bCheckConfig || adminCmd == "" {
+		if errors := reportConfig(cfgFile, bCheckConfig); bCheckConfig || errors > 0 {
+			if errors > 0 {
+				os.Exit(1)
+			}
+			fmt.Printf("%s: OK\n", cfgFile)
+			os.Exit(0)
+		}
+	}
+	aclAllow, groupMembers = declareACLs(globalOptions{}, cfgFile)
+	limitOptionMap = declareLimits(globalOptions{}, cfgFile)
 	if err := config.Parse(cfgFile); err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cfgFile, err)
+		os.Exit(1)
+	}
+	if adminCmd != "" {
+		os.Exit(adminCommand(adminCmd, flag.Args()))
 	}
 
 	if  verbose {
@@ -332,11 +480,22 @@ func main() {
 	var ip [4]int
 	_, err := fmt.Sscanf(*startip, "%d.%d.%d.%d", &ip[0], &ip[1], &ip[2], &ip[3])
 	if err != nil {
-		panic(err)
+		configError(cfgFile, "startip", "%q is not an IPv4 address", *startip)
+	}
+	// the IPv6 pool is optional and paired with the IPv4 one, tap by tap
+	var ip6 net.IP
+	if *startip6 != "" {
+		ip6 = net.ParseIP(*startip6)
+		if ip6 == nil || ip6.To4() != nil {
+			configError(cfgFile, "startip6", "%q is not an IPv6 address", *startip6)
+		}
 	}
 	for i := 0; i < maxTap; i++ {
 		tapNames[i] = fmt.Sprintf("%s%1d",*tapname,*starttap+i)
 		ipAddr[i] = fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3]+i*(*stepip))
+		if ip6 != nil {
+			ip6Addr[i] = addIP6(ip6, i*(*stepip6))
+		}
 		port2tap[i] = *startport + i
 	}
 
@@ -345,7 +504,28 @@ func main() {
 	http.HandleFunc("/list/", listHandler)
 	http.HandleFunc("/ip/", ipHandler)
 	http.HandleFunc("/port/", portHandler)
-	http.ListenAndServe(*listenhost + *listenport, nil)
+	http.HandleFunc("/admin/", adminHandler)
+	startAccounting()
+	reloadOnHangup()
+	stopOnTerm()
+	// socket activation by systemd takes the place of the listen addresses
+	listeners, err := systemdListeners()
+	if err == nil && len(listeners) == 0 {
+		addresses, _ := listenAddresses(*listen, *listenhost, *listenport)
+		mode, _ := parseListenMode(*listenmode)
+		listeners, err = openListeners(addresses, mode)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sdNotify("READY=1")
+	sdStatus()
+	startWatchdog(listeners)
+	if err := serve(listeners); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 
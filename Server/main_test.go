@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// startWatched starts a tapdaemon stand-in on slot i as allocateHandler does
+func startWatched(t *testing.T, i int, name string, arg string) (*exec.Cmd, chan bool) {
+	cmd := exec.Command("sleep", arg)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	allocLock.Lock()
+	defer allocLock.Unlock()
+	allocNames[i], cmds[i] = name, cmd
+	done := make(chan bool)
+	go func(generation int) {
+		execWatch(i, generation, cmd)
+		close(done)
+	}(slotGeneration[i])
+	return cmd, done
+}
+
+// releaseSlot releases slot i as the handlers do
+func releaseSlot(i int) {
+	allocLock.Lock()
+	defer allocLock.Unlock()
+	release(i)
+}
+
+func wait(t *testing.T, done chan bool) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("execWatch did not return")
+	}
+}
+
+func TestExecWatch(t *testing.T) {
+	bDryrun = true
+	defer func() { bDryrun = false }()
+	tapNames[0] = "tap0"
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T)
+	}{
+		{"tapdaemon exits", func(t *testing.T) {
+			_, done := startWatched(t, 0, "alice_0", "0")
+			wait(t, done)
+			if allocNames[0] != "" || cmds[0] != nil {
+				t.Errorf("slot holds %q, %v after its tapdaemon exited", allocNames[0], cmds[0])
+			}
+		}},
+		{"released", func(t *testing.T) {
+			cmd, done := startWatched(t, 0, "alice_0", "60")
+			releaseSlot(0)
+			wait(t, done)
+			if cmd.ProcessState == nil {
+				t.Errorf("tapdaemon not waited for")
+			}
+			if allocNames[0] != "" || cmds[0] != nil {
+				t.Errorf("slot holds %q, %v after release", allocNames[0], cmds[0])
+			}
+		}},
+		{"slot taken again", func(t *testing.T) {
+			old, done := startWatched(t, 0, "alice_0", "60")
+			releaseSlot(0)
+			next, nextDone := startWatched(t, 0, "bob_1", "60")
+			wait(t, done)
+			if old.ProcessState == nil {
+				t.Errorf("old tapdaemon not waited for")
+			}
+			if allocNames[0] != "bob_1" || cmds[0] != next {
+				t.Errorf("old watcher cleared the next allocation, slot holds %q", allocNames[0])
+			}
+			releaseSlot(0)
+			wait(t, nextDone)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, test.run)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Tunneling Recursive Router
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	config "github.com/stvp/go-toml-config"
+)
+
+// optionSet is where the options of the config file are declared, the
+// global config or a ConfigSet reading the file again.
+type optionSet interface {
+	String(name string, value string) *string
+	Int(name string, value int) *int
+}
+
+type globalOptions struct{}
+
+func (globalOptions) String(name string, value string) *string { return config.String(name, value) }
+func (globalOptions) Int(name string, value int) *int          { return config.Int(name, value) }
+
+var stringOptions = map[string]*string{
+	"tapname": tapname, "startip": startip, "startip6": startip6, "tapdaemon": tapdaemon,
+	"listenhost": listenhost, "listenport": listenport, "listen": listen, "listenmode": listenmode,
+	"serverdaemon": serverdaemon,
+	"serverstartport": serverstartport, "serverendport": serverendport, "iptables": iptables,
+	"ip6tables": ip6tables, "usagefile": usagefile, "tc": tc, "admintoken": admintoken,
+}
+
+var intOptions = map[string]*int{
+	"numtap": numtap, "starttap": starttap, "startport": startport, "stepip": stepip,
+	"stepip6": stepip6, "ratelimit": ratelimit, "quota": monthquota,
+}
+
+// restartOptions lay out the taps and the listener, so they are only read at
+// start. The other options are used for each allocation and can change while
+// the Server runs, numtap as long as no allocation is left out of the pool.
+var restartOptions = map[string]bool{
+	"tapname": true, "starttap": true, "startport": true, "startip": true, "stepip": true,
+	"startip6": true, "stepip6": true, "listenhost": true, "listenport": true, "listen": true,
+	"listenmode": true,
+}
+
+var stringDefaults = map[string]string{}
+var intDefaults = map[string]int{}
+
+// recordDefaults keeps the defaults of the options, which a reload falls back
+// to for the options taken out of the file.
+func recordDefaults() {
+	for name, value := range stringOptions {
+		stringDefaults[name] = *value
+	}
+	for name, value := range intOptions {
+		intDefaults[name] = *value
+	}
+}
+
+// newConfig is the config file as read again
+type newConfig struct {
+	strings map[string]*string
+	ints    map[string]*int
+	acls    map[string]*string
+	groups  map[string]*string
+	limits  map[string]*limitOptions
+}
+
+// readConfig reads and checks the config file without touching the running
+// config.
+func readConfig(path string) (*newConfig, error) {
+	set := config.NewConfigSet(path, flag.ContinueOnError)
+	c := &newConfig{strings: map[string]*string{}, ints: map[string]*int{}}
+	for name, value := range stringDefaults {
+		c.strings[name] = set.String(name, value)
+	}
+	for name, value := range intDefaults {
+		c.ints[name] = set.Int(name, value)
+	}
+	c.acls, c.groups = declareACLs(set, path)
+	c.limits = declareLimits(set, path)
+	if err := set.Parse(path); err != nil {
+		return nil, err
+	}
+	return c, c.check()
+}
+
+// check returns the errors of the config, leaving out the warnings and the
+// advisory problems
+func (c *newConfig) check() error {
+	var errors []string
+	for _, p := range c.problems() {
+		if !p.warning && !p.advisory {
+			errors = append(errors, p.option+": "+p.problem)
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, ", "))
+	}
+	return nil
+}
+
+// reloadConfig reads the config file again and applies it if every change
+// can be made while running. The changes are returned, or all of the
+// changes refused. When an allocation cannot get its new ACL the old config
+// is kept.
+func reloadConfig() ([]string, error) {
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+	c, err := readConfig(cfgFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfgFile, err)
+	}
+	allocLock.Lock()
+	defer allocLock.Unlock()
+
+	var changes, refused []string
+	for name, value := range c.strings {
+		if *value != *stringOptions[name] {
+			changes = append(changes, fmt.Sprintf("%s %q -> %q", name, *stringOptions[name], *value))
+			if restartOptions[name] {
+				refused = append(refused, name+" needs a restart")
+			}
+		}
+	}
+	for name, value := range c.ints {
+		if *value != *intOptions[name] {
+			changes = append(changes, fmt.Sprintf("%s %d -> %d", name, *intOptions[name], *value))
+			if restartOptions[name] {
+				refused = append(refused, name+" needs a restart")
+			}
+		}
+	}
+	for i := *c.ints["numtap"]; i < maxTap; i++ {
+		if allocNames[i] != "" {
+			refused = append(refused, fmt.Sprintf("numtap %d leaves out %s on %s", *c.ints["numtap"], allocNames[i], tapNames[i]))
+		}
+	}
+	// the ACLs are all checked before any allocation gets one
+	acls := map[int]*ACL{}
+	if err := validateACLs(c.acls); err != nil {
+		refused = append(refused, err.Error())
+	} else {
+		for i, name := range allocNames {
+			if name != "" {
+				acls[i], _ = aclOf(name, c.acls, c.groups)
+			}
+		}
+	}
+	if len(refused) > 0 {
+		sort.Strings(refused)
+		return nil, fmt.Errorf("%s not reloaded: %s", cfgFile, strings.Join(refused, ", "))
+	}
+
+	old := keepConfig()
+	c.apply()
+	// the allocations get the ACLs as they are now
+	for i, acl := range acls {
+		if err := setACL(i, acl); err != nil {
+			old.apply()
+			restoreACLs()
+			return nil, fmt.Errorf("%s not reloaded: acl of %s: %v", cfgFile, allocNames[i], err)
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// keepConfig copies the config in use, for a reload to fall back to
+func keepConfig() *newConfig {
+	c := &newConfig{strings: map[string]*string{}, ints: map[string]*int{},
+		acls: aclAllow, groups: groupMembers, limits: limitOptionMap}
+	for name, value := range stringOptions {
+		v := *value
+		c.strings[name] = &v
+	}
+	for name, value := range intOptions {
+		v := *value
+		c.ints[name] = &v
+	}
+	return c
+}
+
+// apply makes a config the one in use
+func (c *newConfig) apply() {
+	for name, value := range c.strings {
+		*stringOptions[name] = *value
+	}
+	for name, value := range c.ints {
+		*intOptions[name] = *value
+	}
+	aclAllow, groupMembers, limitOptionMap = c.acls, c.groups, c.limits
+}
+
+// setACL gives an allocation its ACL, or takes its ACL away for none
+func setACL(index int, acl *ACL) error {
+	if acl == nil {
+		removeACL(index)
+		leaveCgroup(index)
+		return nil
+	}
+	return applyACL(index, allocNames[index], acl)
+}
+
+// restoreACLs gives the allocations their ACLs of the config in use again
+// after a failed reload, releasing an allocation that cannot have it.
+func restoreACLs() {
+	for i, name := range allocNames {
+		if name == "" {
+			continue
+		}
+		acl, err := aclFor(name)
+		if err == nil {
+			err = setACL(i, acl)
+		}
+		if err != nil {
+			fmt.Println(err)
+			fmt.Printf("releasing %s\n", name)
+			release(i)
+		}
+	}
+}
+
+// reloadOnHangup reloads the config file on SIGHUP
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			changes, err := reloadConfig()
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("%s reloaded\n", cfgFile)
+			for _, change := range changes {
+				fmt.Println("  " + change)
+			}
+		}
+	}()
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestKeepConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func()
+	}{
+		{"string option", func() { *iptables = "false" }},
+		{"int option", func() { *numtap = 7 }},
+		{"acls", func() { aclAllow = map[string]*string{"alice": new(string)} }},
+		{"limits", func() { limitOptionMap = map[string]*limitOptions{"alice": {}} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bin, n, acls, limits := *iptables, *numtap, len(aclAllow), len(limitOptionMap)
+			old := keepConfig()
+			test.change()
+			old.apply()
+			if *iptables != bin || *numtap != n || len(aclAllow) != acls || len(limitOptionMap) != limits {
+				t.Errorf("config not kept: iptables %q, numtap %d, %d acls, %d limits", *iptables, *numtap, len(aclAllow), len(limitOptionMap))
+			}
+		})
+	}
+}
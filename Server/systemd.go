@@ -0,0 +1,194 @@
+/*
+Tunneling Recursive Router
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The Server runs under systemd as a Type=notify service, optionally socket
+// activated for the control API:
+//
+//   [Service]
+//   Type=notify
+//   ExecStart=/usr/sbin/trr-server -c /etc/trr/trr.cfg
+//   ExecReload=/bin/kill -HUP $MAINPID
+//   WatchdogSec=30
+//
+// With a trr-server.socket unit the listen addresses come from systemd and
+// the listen option is not used. Both protocols are implemented here, the
+// notifications going to the datagram socket of NOTIFY_SOCKET, which can be
+// any socket listened on for testing.
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// systemdListeners returns the listeners passed by socket activation, none
+// if the Server was not socket activated.
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		// the daemons started for the allocations must not inherit them
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s from systemd: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state such as "READY=1" to the service manager. It does
+// nothing when the Server is not run by one.
+func sdNotify(state ...string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "@") {
+		// an abstract socket
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n") + "\n"))
+	return err
+}
+
+// sdStatus reports the state of the pool as the status of the service
+func sdStatus() {
+	allocated := 0
+	for _, name := range allocNames {
+		if name != "" {
+			allocated++
+		}
+	}
+	status := fmt.Sprintf("STATUS=%d of %d taps allocated", allocated, *numtap)
+	if bDraining {
+		status += ", draining"
+	}
+	sdNotify(status)
+}
+
+// watchdogInterval returns the watchdog timeout asked for by systemd, 0 if
+// there is none.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings the watchdog at half its timeout for as long as the
+// listeners accept connections, so that systemd restarts a Server that
+// stopped serving.
+func startWatchdog(listeners []net.Listener) {
+	timeout := watchdogInterval()
+	if timeout == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(timeout / 2) {
+			if serving(listeners) {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// serving tells whether the first TCP or Unix listener accepts connections
+func serving(listeners []net.Listener) bool {
+	for _, l := range listeners {
+		addr := l.Addr()
+		if addr.Network() != "tcp" && addr.Network() != "unix" {
+			continue
+		}
+		c, err := net.DialTimeout(addr.Network(), addr.String(), time.Second)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+	return true
+}
+
+// stopOnTerm releases every allocation and exits on SIGTERM or SIGINT,
+// telling the service manager that the Server is stopping. The allocation
+// lock is kept until the exit, so no request allocates a slot meanwhile.
+func stopOnTerm() {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-term
+		fmt.Printf("%v, stopping\n", sig)
+		sdNotify("STOPPING=1", "STATUS=stopping")
+		allocLock.Lock()
+		for i, name := range allocNames {
+			if name != "" {
+				release(i)
+			}
+		}
+		os.Exit(0)
+	}()
+}
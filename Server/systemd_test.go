@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifySocket listens for notifications as systemd does
+func notifySocket(t *testing.T, name string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSdNotify(t *testing.T) {
+	dir := t.TempDir()
+	abstract := fmt.Sprintf("trr-test-%d", os.Getpid())
+	tests := []struct {
+		name   string
+		socket string
+		listen string
+		state  []string
+		want   string
+	}{
+		{"ready", filepath.Join(dir, "a.sock"), filepath.Join(dir, "a.sock"), []string{"READY=1"}, "READY=1\n"},
+		{"several", filepath.Join(dir, "b.sock"), filepath.Join(dir, "b.sock"), []string{"STOPPING=1", "STATUS=stopping"}, "STOPPING=1\nSTATUS=stopping\n"},
+		{"abstract", "@" + abstract, "\x00" + abstract, []string{"WATCHDOG=1"}, "WATCHDOG=1\n"},
+	}
+	for _, test := range tests {
+		conn := notifySocket(t, test.listen)
+		t.Setenv("NOTIFY_SOCKET", test.socket)
+		if err := sdNotify(test.state...); err != nil {
+			t.Errorf("%s: sdNotify: %v", test.name, err)
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 256)
+		n, err := conn.Read(b)
+		if err != nil || string(b[:n]) != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.name, b[:n], err, test.want)
+		}
+		conn.Close()
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without a service manager: %v", err)
+	}
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone.sock"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Errorf("sdNotify to a missing socket succeeded")
+	}
+}
+
+// TestHelperListeners stands in for a socket activated Server when run by
+// TestSystemdListeners, which passes it the sockets from fd 3 on.
+func TestHelperListeners(t *testing.T) {
+	pid := os.Getenv("TRR_HELPER_LISTEN_PID")
+	if pid == "" {
+		t.Skip("helper process")
+	}
+	if pid == "self" {
+		os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+	} else {
+		os.Setenv("LISTEN_PID", pid)
+	}
+	listeners, err := systemdListeners()
+	if err != nil {
+		fmt.Printf("error %v\n", err)
+		return
+	}
+	for _, l := range listeners {
+		fmt.Printf("listener %s\n", l.Addr())
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if os.Getenv(env) != "" {
+			fmt.Printf("%s left set\n", env)
+		}
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, "listener "+l.Addr().String())
+	}
+
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+		want []string
+	}{
+		{"activated", "self", "2", addrs},
+		{"first only", "self", "1", addrs[:1]},
+		{"other pid", "1", "2", nil},
+		{"no fds", "self", "0", nil},
+		{"bad fds", "self", "two", nil},
+	}
+	for _, test := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperListeners$")
+		cmd.ExtraFiles = files
+		cmd.Env = append(os.Environ(), "TRR_HELPER_LISTEN_PID="+test.pid, "LISTEN_FDS="+test.fds, "LISTEN_FDNAMES=api:api6")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", test.name, err, out)
+		}
+		var got []string
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "listener ") || strings.HasPrefix(line, "error ") || strings.HasSuffix(line, " left set") {
+				got = append(got, line)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := fmt.Sprint(os.Getpid())
+	tests := []struct {
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{"30000000", "", 30 * time.Second},
+		{"30000000", self, 30 * time.Second},
+		{"500000", self, 500 * time.Millisecond},
+		{"30000000", "1", 0},
+		{"0", "", 0},
+		{"-5", "", 0},
+		{"soon", "", 0},
+		{"", "", 0},
+	}
+	for _, test := range tests {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if got := watchdogInterval(); got != test.want {
+			t.Errorf("watchdogInterval(%q, pid %q) = %v, want %v", test.usec, test.pid, got, test.want)
+		}
+	}
+}
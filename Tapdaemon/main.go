@@ -0,0 +1,192 @@
+/*
+Tunneling Recursive Router tapdaemon
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// tapdaemon <tap> <port> is run by the Server for each allocation. It creates
+// the tap device and bridges it to the tap command of the Client, which
+// reaches it through the transport at localhost:<port> on the Server.
+//
+// The connection carries ethernet frames in both directions, each one as a
+// record of its length in two bytes, big endian, followed by the frame:
+//
+//	+-----------------+---------------------+
+//	| length (16 bit) | frame, length bytes |
+//	+-----------------+---------------------+
+//
+// This is the framing of framedConn in the Client. One connection is bridged
+// at a time, a new one takes over from the one before, and frames from the
+// tap while nobody is connected are dropped. tapdaemon exits when the tap
+// fails, which releases the allocation in the Server.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// maxFrame is the largest frame a length of two bytes can carry
+const maxFrame = 65535
+
+// writeFrame writes frame as one record
+func writeFrame(w io.Writer, frame []byte) error {
+	if len(frame) > maxFrame {
+		return errors.New("frame too large")
+	}
+	record := make([]byte, 2+len(frame))
+	binary.BigEndian.PutUint16(record, uint16(len(frame)))
+	copy(record[2:], frame)
+	_, err := w.Write(record)
+	return err
+}
+
+// readFrame reads one record into buf and returns the length of its frame
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("frame of %d bytes too large", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// bridge holds the connection the frames of the tap go to
+type bridge struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (b *bridge) current() net.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn
+}
+
+// take makes c the bridged connection, closing the one before
+func (b *bridge) take(c net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.conn = c
+}
+
+func (b *bridge) drop(c net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == c {
+		b.conn = nil
+	}
+	c.Close()
+}
+
+// serve copies the frames from c to the tap until c ends
+func (b *bridge) serve(c net.Conn, dev io.Writer) {
+	defer b.drop(c)
+	buf := make([]byte, maxFrame)
+	for {
+		n, err := readFrame(c, buf)
+		if err != nil {
+			return
+		}
+		if _, err := dev.Write(buf[:n]); err != nil {
+			log.Printf("write to tap: %v", err)
+		}
+	}
+}
+
+// fromTap copies the frames of the tap to the bridged connection
+func (b *bridge) fromTap(dev io.Reader) error {
+	buf := make([]byte, maxFrame)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		if c := b.current(); c != nil {
+			if err := writeFrame(c, buf[:n]); err != nil {
+				b.drop(c)
+			}
+		}
+	}
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <tap> <port>\n", os.Args[0])
+		os.Exit(2)
+	}
+	port, err := strconv.Atoi(os.Args[2])
+	if err != nil || port < 1 || port > 65535 {
+		fmt.Fprintf(os.Stderr, "bad port %s\n", os.Args[2])
+		os.Exit(2)
+	}
+
+	dev, name, err := openTap(os.Args[1])
+	if err != nil {
+		log.Fatalf("tap %s: %v", os.Args[1], err)
+	}
+	if err := linkUp(name); err != nil {
+		log.Fatalf("tap %s: %v", name, err)
+	}
+
+	// the Client dials localhost, which may be either loopback address
+	var listeners []net.Listener
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, os.Args[2]))
+		if err != nil {
+			log.Printf("listen on %s: %v", net.JoinHostPort(host, os.Args[2]), err)
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		log.Fatalf("no address to listen on for %s", name)
+	}
+
+	b := &bridge{}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					log.Fatalf("accept on %s: %v", l.Addr(), err)
+				}
+				log.Printf("%s bridged to %s", name, c.RemoteAddr())
+				b.take(c)
+				go b.serve(c, dev)
+			}
+		}(l)
+	}
+	log.Fatalf("tap %s: %v", name, b.fromTap(dev))
+}
@@ -0,0 +1,116 @@
+/*
+Tunneling Recursive Router tapdaemon
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"empty", [][]byte{{}}},
+		{"one", [][]byte{[]byte("frame")}},
+		{"several", [][]byte{[]byte("a"), {}, bytes.Repeat([]byte{0xff}, 1500)}},
+		{"largest", [][]byte{bytes.Repeat([]byte{1}, maxFrame)}},
+	}
+	for _, tt := range tests {
+		var wire bytes.Buffer
+		for _, frame := range tt.frames {
+			if err := writeFrame(&wire, frame); err != nil {
+				t.Fatalf("%s: writeFrame: %v", tt.name, err)
+			}
+		}
+		buf := make([]byte, maxFrame)
+		for i, frame := range tt.frames {
+			n, err := readFrame(&wire, buf)
+			if err != nil {
+				t.Fatalf("%s: readFrame %d: %v", tt.name, i, err)
+			}
+			if !bytes.Equal(buf[:n], frame) {
+				t.Errorf("%s: frame %d is %d bytes, want %d", tt.name, i, n, len(frame))
+			}
+		}
+		if wire.Len() != 0 {
+			t.Errorf("%s: %d bytes left over", tt.name, wire.Len())
+		}
+	}
+}
+
+func TestFrameWire(t *testing.T) {
+	var wire bytes.Buffer
+	writeFrame(&wire, []byte{0xaa, 0xbb, 0xcc})
+	if want := []byte{0, 3, 0xaa, 0xbb, 0xcc}; !bytes.Equal(wire.Bytes(), want) {
+		t.Errorf("wire is % x, want % x", wire.Bytes(), want)
+	}
+	if err := writeFrame(&wire, make([]byte, maxFrame+1)); err == nil {
+		t.Errorf("frame of %d bytes written", maxFrame+1)
+	}
+	if _, err := readFrame(bytes.NewReader([]byte{0, 10, 1, 2}), make([]byte, 10)); err == nil {
+		t.Errorf("short frame read")
+	}
+	if _, err := readFrame(bytes.NewReader([]byte{0, 10}), make([]byte, 4)); err == nil {
+		t.Errorf("frame larger than the buffer read")
+	}
+}
+
+// a new connection takes over, frames of the tap go to it only
+func TestBridgeTakeOver(t *testing.T) {
+	b := &bridge{}
+	old, oldPeer := net.Pipe()
+	b.take(old)
+	conn, peer := net.Pipe()
+	b.take(conn)
+
+	oldPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := oldPeer.Read(make([]byte, 1)); err == nil {
+		t.Errorf("old connection still open")
+	}
+	if b.current() != conn {
+		t.Fatalf("new connection not bridged")
+	}
+
+	go b.fromTap(bytes.NewReader([]byte("frame")))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxFrame)
+	n, err := readFrame(peer, buf)
+	if err != nil || string(buf[:n]) != "frame" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+
+	b.drop(old)
+	if b.current() != conn {
+		t.Errorf("dropping the old connection unbridged the new one")
+	}
+	b.drop(conn)
+	if b.current() != nil {
+		t.Errorf("connection bridged after drop")
+	}
+}
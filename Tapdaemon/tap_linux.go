@@ -0,0 +1,95 @@
+//go:build linux
+
+/*
+Tunneling Recursive Router tapdaemon
+
+Copyright (c) 2014 Bjorn Runaker
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	iffTap    = 0x0002
+	iffNoPi   = 0x1000
+	tunSetIff = 0x400454ca
+)
+
+// ifreq is struct ifreq: the name followed by the flags
+type ifreq [40]byte
+
+func newIfreq(name string) *ifreq {
+	var ifr ifreq
+	copy(ifr[:syscall.IFNAMSIZ-1], name)
+	return &ifr
+}
+
+func (ifr *ifreq) flags() *uint16 {
+	return (*uint16)(unsafe.Pointer(&ifr[syscall.IFNAMSIZ]))
+}
+
+func (ifr *ifreq) name() string {
+	return strings.TrimRight(string(ifr[:syscall.IFNAMSIZ]), "\x00")
+}
+
+func ioctl(fd uintptr, request uintptr, ifr *ifreq) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openTap creates the tap device without packet information, so that reads
+// and writes are whole ethernet frames.
+func openTap(name string) (*os.File, string, error) {
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	ifr := newIfreq(name)
+	*ifr.flags() = iffTap | iffNoPi
+	if err := ioctl(f.Fd(), tunSetIff, ifr); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return f, ifr.name(), nil
+}
+
+// linkUp sets the device up, the addresses are left to the host
+func linkUp(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	ifr := newIfreq(name)
+	if err := ioctl(uintptr(fd), syscall.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	*ifr.flags() |= syscall.IFF_UP
+	return ioctl(uintptr(fd), syscall.SIOCSIFFLAGS, ifr)
+}